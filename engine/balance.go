@@ -2,35 +2,52 @@ package engine
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type breq struct {
 	key         []byte
-	storages    []string
+	ent         entry.Entry
 	keyStorages []string
+
+	// record is set when balancing an old version of the key.
+	record *versionRecord
 }
 
 func (e *Engine) balance(r breq) bool {
-	keyHash := entry.HashKey(r.key)
+	if r.ent.Sharded() {
+		return e.balanceShards(r)
+	}
+
+	if r.ent.Chunked() {
+		return e.balanceChunks(r)
+	}
+	keyHash := r.ent.Path(r.key)
 
 	// filter available volumes
 	storages := make([]string, 0)
-	for _, s := range r.storages {
-		addr := fmt.Sprintf("http://%s%s", s, keyHash)
-		ok, err := httpheader(addr, 1*time.Minute)
-		if err != nil {
-			return false
+	for _, s := range r.ent.Storages {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		_, err := e.volume(s).Head(ctx, keyHash)
+		cancel()
+
+		if errors.Is(err, volume.ErrNotFound) {
+			continue
 		}
 
-		if ok {
-			storages = append(storages, s)
+		if err != nil {
+			return false
 		}
+		storages = append(storages, s)
 	}
 
 	if len(storages) == 0 {
@@ -41,21 +58,6 @@ func (e *Engine) balance(r breq) bool {
 		return true
 	}
 
-	var err error = nil
-	var ss []byte
-	for _, s := range storages {
-		addr := fmt.Sprintf("http://%s%s", s, keyHash)
-
-		ss, err = httpget(addr)
-		if err == nil {
-			break
-		}
-	}
-
-	if err != nil {
-		return false
-	}
-
 	balanceErr := false
 	for _, s := range r.keyStorages {
 		shouldWrite := true
@@ -67,8 +69,14 @@ func (e *Engine) balance(r breq) bool {
 		}
 
 		if shouldWrite {
-			addr := fmt.Sprintf("http://%s%s", s, keyHash)
-			if err := httpput(addr, bytes.NewReader(ss), int64(len(ss))); err != nil {
+			var err error
+			for _, from := range storages {
+				if err = e.copyValue(from, s, keyHash); err == nil {
+					break
+				}
+			}
+
+			if err != nil {
 				log.Printf("error balancing put: %s\n", err)
 				balanceErr = true
 			}
@@ -79,13 +87,8 @@ func (e *Engine) balance(r breq) bool {
 		return false
 	}
 
-	if err := e.Put(r.key, entry.Entry{
-		Storages: r.keyStorages,
-		Status:   entry.Exists,
-		Hash:     "",
-	}); err != nil {
-		log.Printf("failed putting into database when balancing: %s\n", err)
-	}
+	r.ent.Storages = r.keyStorages
+	e.balanced(r)
 
 	delErr := false
 	for _, s := range storages {
@@ -98,8 +101,7 @@ func (e *Engine) balance(r breq) bool {
 		}
 
 		if shouldDelete {
-			addr := fmt.Sprintf("http://%s%s", s, keyHash)
-			if err := httpdel(addr); err != nil {
+			if err := e.volume(s).Delete(context.Background(), keyHash); err != nil {
 				log.Printf("balance del error: %s\n", err)
 				delErr = true
 			}
@@ -109,6 +111,83 @@ func (e *Engine) balance(r breq) bool {
 	return !delErr
 }
 
+// balanced stores the balanced entry of the request, or the version record if
+// an old version was balanced.
+func (e *Engine) balanced(r breq) {
+	ent := r.ent
+	if !ent.Trashed() {
+		ent.Status = entry.Exists
+	}
+
+	var err error
+	switch {
+	case ent.Dedup:
+		err = e.setBlobStorages(r.key, ent)
+	case r.record != nil:
+		r.record.set(ent)
+		err = e.putVersion(r.key, r.record)
+	default:
+		err = e.Put(r.key, ent)
+	}
+
+	if err != nil {
+		log.Printf("failed putting into database when balancing: %s\n", err)
+	}
+}
+
+// balanceShards moves the shards of an erasure coded value to the storages
+// where they belong. The shards are copied when possible, and shards that are
+// missing are decoded from the rest.
+func (e *Engine) balanceShards(r breq) bool {
+	if !shouldBalance(r.ent.Storages, r.keyStorages) {
+		return true
+	}
+
+	for i, s := range r.keyStorages {
+		from := ""
+		if i < len(r.ent.Storages) {
+			from = r.ent.Storages[i]
+		}
+
+		if s == from {
+			continue
+		}
+
+		path := r.ent.FilePath(r.key, i)
+		err := volume.ErrNotFound
+		if from != "" {
+			err = e.copyValue(from, s, path)
+		}
+
+		if errors.Is(err, volume.ErrNotFound) {
+			err = e.rebuildShard(r.key, r.ent, i, s)
+		}
+
+		if err != nil {
+			log.Printf("error balancing shard %d of %s: %s\n", i, r.key, err)
+			return false
+		}
+	}
+
+	old := r.ent.Storages
+	r.ent.Storages = r.keyStorages
+	e.balanced(r)
+
+	delErr := false
+	for i, s := range old {
+		if s == "" || (i < len(r.keyStorages) && r.keyStorages[i] == s) {
+			continue
+		}
+
+		if err := e.volume(s).Delete(context.Background(), r.ent.FilePath(r.key, i)); err != nil {
+			log.Printf("balance del error: %s\n", err)
+			delErr = true
+		}
+	}
+
+	return !delErr
+}
+
 func (e *Engine) Balance() {
 	var wg sync.WaitGroup
 	requests := make(chan breq, 20000)
@@ -122,21 +201,52 @@ func (e *Engine) Balance() {
 		}()
 	}
 
-	it := e.DB.NewIterator(nil, nil)
-	defer it.Release()
-
+	it := e.DB.NewIterator(objectRange, nil)
 	for it.Next() {
 		key := make([]byte, len(it.Key()))
 		copy(key, it.Key())
-		ent := entry.EntryFromBytes(it.Value())
-		keyStorages := entry.KeyToStorage(key, e.Storages, e.ReplicaCount, e.SubstorageCount)
+		ent := e.blobEntry(key, entry.EntryFromBytes(it.Value()))
+		keyStorages := e.keyStorages(key, ent)
 
 		requests <- breq{
 			key:         key,
-			storages:    ent.Storages,
+			ent:         ent,
 			keyStorages: keyStorages,
 		}
 	}
+	it.Release()
+
+	// the old versions of keys are balanced the same way. The latest version
+	// was already balanced through the entry.
+	it = e.DB.NewIterator(util.BytesPrefix(versionPrefix), nil)
+	for it.Next() {
+		k := it.Key()[len(versionPrefix):]
+		sep := bytes.LastIndexByte(k, 0)
+		if sep < 0 {
+			continue
+		}
+
+		var v versionRecord
+		if err := json.Unmarshal(it.Value(), &v); err != nil || v.DeleteMarker {
+			continue
+		}
+
+		key := make([]byte, sep)
+		copy(key, k[:sep])
+		if ent := e.Get(key); ent.Status == entry.Exists && ent.Version == v.ID {
+			continue
+		}
+
+		ent := e.blobEntry(key, v.entry())
+		requests <- breq{
+			key:         key,
+			ent:         ent,
+			keyStorages: e.keyStorages(key, ent),
+			record:      &v,
+		}
+	}
+	it.Release()
+
 	close(requests)
 	wg.Wait()
 }
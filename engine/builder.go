@@ -1,103 +1,266 @@
 package engine
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type rreq struct {
 	storage string
-	addr    string
+	group   string
+	dir     string
 }
 
-type rfile struct {
-	name string
-	ty   string
+// storageFiles lists the files in a directory of a storage. Errors are treated
+// the same as an empty directory.
+func (e *Engine) storageFiles(storage, dir string) []volume.File {
+	files, err := e.volume(storage).List(context.Background(), dir)
+	if err != nil {
+		return nil
+	}
+	return files
 }
 
-func addrFiles(addr string) []rfile {
-	var files []rfile
+// builtFile is a file found on a storage while building the index.
+type builtFile struct {
+	storage string
+	size    int64
+	modTime time.Time
 
-	b, err := httpget(addr)
-	if err != nil {
-		return files
+	// shard is the header of a shard of an erasure coded value and chunk is
+	// the index of a chunk of a chunked value, or -1.
+	shard *shardHeader
+	chunk int
+}
+
+// splitIndex splits the suffix of a shard or chunk file from its name. The
+// index is -1 if the file is neither.
+func splitIndex(name string) (string, byte, int) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 || len(name) < i+3 || (name[i+1] != 's' && name[i+1] != 'c') {
+		return name, 0, -1
 	}
 
-	json.Unmarshal(b, &files)
-	return files
+	idx, err := strconv.Atoi(name[i+2:])
+	if err != nil || idx < 0 {
+		return name, 0, -1
+	}
+	return name[:i], name[i+1], idx
+}
+
+// add adds the file into the entry of its value. Replicas are ordered by
+// keyStorages, shards are placed by their index and chunks are added into
+// their chunk.
+func (bf *builtFile) add(ent *entry.Entry, keyStorages []string) {
+	switch {
+	case bf.shard != nil:
+		if !ent.Sharded() {
+			bf.shard.apply(ent)
+		}
+
+		placed := make([]string, bf.shard.DataShards+bf.shard.ParityShards)
+		copy(placed, ent.Storages)
+		placed[bf.shard.Index] = bf.storage
+		ent.Storages = placed
+	case bf.chunk >= 0:
+		for len(ent.Chunks) <= bf.chunk {
+			ent.Chunks = append(ent.Chunks, entry.Chunk{Storages: []string{}})
+		}
+
+		c := &ent.Chunks[bf.chunk]
+		if len(missingStorages(c.Storages, []string{bf.storage})) > 0 {
+			c.Storages = append(c.Storages, bf.storage)
+		}
+		c.Size = bf.size
+
+		ent.Storages = []string{}
+		ent.Size = 0
+		for _, c := range ent.Chunks {
+			ent.Size += c.Size
+		}
+	default:
+		if len(missingStorages(ent.Storages, []string{bf.storage})) > 0 {
+			ent.Storages = orderStorages(append(ent.Storages, bf.storage), keyStorages)
+		}
+	}
 }
 
-func (e *Engine) buildFile(storage, name string) error {
+// buildFile adds a file found on a storage of a group to the index.
+func (e *Engine) buildFile(storage, group, dir string, f volume.File) error {
+	// versioned values have the version after the encoded key. The base64
+	// alphabet doesn't contain dots. Shards of erasure coded values and
+	// chunks of chunked values also have their index.
+	bf := builtFile{storage: storage, size: f.Size, modTime: f.ModTime.UTC(), chunk: -1}
+	name, kind, idx := splitIndex(f.Name)
+	if kind == 'c' {
+		bf.chunk = idx
+	}
+
+	version := ""
+	trashed := strings.HasSuffix(name, entry.TrashSuffix)
+	name = strings.TrimSuffix(name, entry.TrashSuffix)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name, version = name[:i], name[i+1:]
+	}
+
 	k, err := base64.StdEncoding.DecodeString(name)
 	if err != nil {
 		return err
 	}
 	skey := string(k)
 
-	keyStorages := entry.KeyToStorage(k, e.Storages, e.ReplicaCount, e.SubstorageCount)
+	// the size of an erasure coded value is only known from the headers of
+	// its shards.
+	layout := entry.Entry{Group: group}
+	if kind == 's' {
+		h, err := e.readShardHeader(storage, dir+f.Name)
+		if err != nil {
+			return err
+		}
+
+		if h.Index != idx {
+			return errShardHeader
+		}
+		bf.shard = &h
+		h.apply(&layout)
+	}
+	keyStorages := e.keyStorages(k, layout)
 
 	if err := e.LockKey(skey); err != nil {
 		return err
 	}
 	defer e.RemoveLock(skey)
 
-	b, err := e.DB.Get(k, nil)
-	var ent entry.Entry
-
-	if err == leveldb.ErrNotFound {
-		ent = entry.Entry{Storages: []string{storage}, Status: entry.Exists, Hash: ""}
-	} else {
-		ent = entry.EntryFromBytes(b)
-		ent.Storages = append(ent.Storages, storage)
+	cur := e.Get(k)
+	if trashed {
+		return e.buildTrash(k, group, version, bf, cur, keyStorages)
 	}
 
-	matching := make([]string, 0)
-	for _, s1 := range keyStorages {
-		for _, s2 := range ent.Storages {
-			if s1 == s2 {
-				matching = append(matching, s1)
-			}
+	// a value that isn't in the trash replaces the one in the trash.
+	if cur.Trashed() {
+		if err := e.DB.Delete(k, nil); err != nil {
+			return err
 		}
+		cur = entry.Entry{Status: entry.HardDeleted}
 	}
 
-	for _, s1 := range ent.Storages {
-		doInsertion := true
-		for _, s2 := range keyStorages {
-			if s1 == s2 {
-				doInsertion = false
-				break
-			}
+	// versioned values are rebuilt through the version records. Without
+	// versioning, the files are in temporary paths of values that replaced
+	// earlier ones, and the newest one is the value of the key.
+	if e.Versioning && (version != "" || cur.Version != "") {
+		return e.buildVersion(k, group, version, bf, cur, keyStorages)
+	}
+
+	b, err := e.DB.Get(k, nil)
+	var ent entry.Entry
+	if err == nil {
+		ent = entry.EntryFromBytes(b)
+		if versionTime(version).Before(versionTime(ent.Version)) {
+			// the replaced value is waiting for garbage collection.
+			return nil
 		}
+	}
 
-		if doInsertion {
-			matching = append(matching, s1)
+	if err == leveldb.ErrNotFound || ent.Version != version {
+		// the content type of the value is lost, but the rest of the metadata
+		// is known from the file.
+		ent = entry.Entry{
+			Status:   entry.Exists,
+			Hash:     "",
+			Version:  version,
+			Size:     f.Size,
+			Created:  bf.modTime,
+			Modified: bf.modTime,
+			Group:    group,
 		}
 	}
 
-	if err := e.Put(k, entry.Entry{
-		Storages: matching,
-		Status:   entry.Exists,
-		Hash:     "",
-	}); err != nil {
+	bf.add(&ent, keyStorages)
+	ent.Status = entry.Exists
+	if err := e.Put(k, ent); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func valid(f rfile) bool {
-	if len(f.name) != 2 || f.ty != "directory" {
+// buildVersion adds a file to the version record of a versioned value and
+// points the entry to the latest version of the key.
+func (e *Engine) buildVersion(key []byte, group, version string, bf builtFile, ent entry.Entry, keyStorages []string) error {
+	// the value the entry points to may not have a record yet.
+	if err := e.archive(key, ent); err != nil {
+		return err
+	}
+
+	v, err := e.getVersion(key, version)
+	if err != nil {
+		v = &versionRecord{ID: version, Created: versionTime(version), Size: bf.size, Group: group}
+	}
+
+	vent := v.entry()
+	bf.add(&vent, keyStorages)
+	v.set(vent)
+
+	if err := e.putVersion(key, v); err != nil {
+		return err
+	}
+
+	latest := e.latestVersion(key)
+	if latest.DeleteMarker {
+		return e.DB.Delete(key, nil)
+	}
+	return e.Put(key, latest.entry())
+}
+
+// buildTrash adds a file to the entry of a value in the trash. The time of the
+// deletion is not known, so the modification time of the file is used, or the
+// current time if the storage doesn't know it.
+func (e *Engine) buildTrash(key []byte, group, version string, bf builtFile, ent entry.Entry, keyStorages []string) error {
+	if ent.Status == entry.Exists {
+		return nil
+	}
+
+	if !ent.Trashed() || ent.Version != version {
+		deleted := bf.modTime
+		if deleted.IsZero() {
+			deleted = time.Now().UTC()
+		}
+
+		ent = entry.Entry{
+			Status:    entry.SoftDeleted,
+			Version:   version,
+			Size:      bf.size,
+			Created:   bf.modTime,
+			Modified:  bf.modTime,
+			Group:     group,
+			DeletedAt: deleted,
+		}
+
+		if err := e.DB.Put(trashKey(key, ent.DeletedAt), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	bf.add(&ent, keyStorages)
+	return e.Put(key, ent)
+}
+
+func valid(f volume.File) bool {
+	if len(f.Name) != 2 || !f.Dir {
 		return false
 	}
 
-	decoded, err := hex.DecodeString(f.name)
+	decoded, err := hex.DecodeString(f.Name)
 	if err != nil {
 		return false
 	}
@@ -110,10 +273,11 @@ func valid(f rfile) bool {
 }
 
 func (e *Engine) Build() {
-	it := e.DB.NewIterator(nil, nil)
+	it := e.DB.NewIterator(objectRange, nil)
 	for it.Next() {
 		e.DB.Delete(it.Key(), nil)
 	}
+	it.Release()
 
 	// waitgroup to ensure that everything has been done.
 	var wg sync.WaitGroup
@@ -125,39 +289,50 @@ func (e *Engine) Build() {
 		go func() {
 			defer wg.Done()
 			for req := range requests {
-				files := addrFiles(req.addr)
-				for _, f := range files {
-					e.buildFile(req.storage, f.name)
+				for _, f := range e.storageFiles(req.storage, req.dir) {
+					if !f.Dir {
+						e.buildFile(req.storage, req.group, req.dir, f)
+					}
 				}
 			}
 		}()
 	}
 
-	parse := func(sto string) {
-		for _, i := range addrFiles(fmt.Sprintf("http://%s/", sto)) {
+	parse := func(sto, group string) {
+		for _, i := range e.storageFiles(sto, "/") {
 			if valid(i) {
-				for _, j := range addrFiles(fmt.Sprintf("http://%s/%s/", sto, i.name)) {
+				for _, j := range e.storageFiles(sto, fmt.Sprintf("/%s/", i.Name)) {
 					if valid(j) {
-						addr := fmt.Sprintf("http://%s/%s/%s/", sto, i.name, j.name)
-						requests <- rreq{sto, addr}
+						requests <- rreq{sto, group, fmt.Sprintf("/%s/%s/", i.Name, j.Name)}
 					}
 				}
 			}
 		}
 	}
 
-	for _, storage := range e.Storages {
+	build := func(storage, group string) {
 		hasSubstorage := false
 
-		for _, f := range addrFiles(fmt.Sprintf("http://%s/", storage)) {
-			if len(f.name) == 4 && strings.HasPrefix(f.name, "sv") && f.ty == "directory" {
-				parse(fmt.Sprintf("%s/%s", storage, f.name))
+		for _, f := range e.storageFiles(storage, "/") {
+			if len(f.Name) == 4 && strings.HasPrefix(f.Name, "sv") && f.Dir {
+				parse(fmt.Sprintf("%s/%s", storage, f.Name), group)
 				hasSubstorage = true
 			}
 		}
 
 		if !hasSubstorage {
-			parse(storage)
+			parse(storage, group)
+		}
+	}
+
+	for _, storage := range e.Storages {
+		build(storage, "")
+	}
+
+	// values moved by the lifecycle rules belong to the group they're found in.
+	for group, storages := range e.Groups {
+		for _, storage := range storages {
+			build(storage, group)
 		}
 	}
 
@@ -0,0 +1,128 @@
+package engine
+
+// checksum.go implements computing the checksum of a value and verifying the
+// checksums that clients send along with a write. The body is hashed while it's
+// streamed to the storages and once the whole body has been received, the
+// checksums are compared. On a mismatch the write is aborted, so truncated or
+// corrupted uploads are never committed. The algorithm of the checksum stored
+// in the index is configurable, see entry.HashAlgo.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nireo/jakaja/entry"
+)
+
+const checksumSHA256Header = "X-Jakaja-Checksum-SHA256"
+
+var errChecksum = errors.New("checksum does not match the received body")
+
+// checksumHeader returns the response header containing a checksum of the
+// given algorithm.
+func checksumHeader(algo entry.HashAlgo) string {
+	if algo == entry.MD5 {
+		return "Content-Md5"
+	}
+	return "X-Jakaja-Checksum-" + strings.ToUpper(algo.String())
+}
+
+// parseChecksums parses the expected checksums of a write. Content-MD5 is the
+// base64 encoded md5 digest of the body. The sha256 digest can be either hex or
+// base64 encoded.
+func parseChecksums(r *http.Request, opts *PutOptions) bool {
+	if h := r.Header.Get("Content-Md5"); h != "" {
+		sum, err := base64.StdEncoding.DecodeString(h)
+		if err != nil || len(sum) != md5.Size {
+			return false
+		}
+		opts.ContentMD5 = sum
+	}
+
+	if h := r.Header.Get(checksumSHA256Header); h != "" {
+		sum, err := hex.DecodeString(h)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(h)
+		}
+
+		if err != nil || len(sum) != sha256.Size {
+			return false
+		}
+		opts.SHA256 = sum
+	}
+
+	return true
+}
+
+// checksumReader hashes the body while it's read. Instead of io.EOF, reading
+// the end of the body returns errChecksum if the body doesn't match the
+// expected checksums.
+type checksumReader struct {
+	r    io.Reader
+	w    io.Writer
+	opts PutOptions
+
+	// size is the amount of bytes read.
+	size int64
+
+	// sum is the checksum stored in the index, md5 and sha256 are only
+	// computed when the client sent them.
+	sum    hash.Hash
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksumReader(r io.Reader, algo entry.HashAlgo, opts PutOptions) *checksumReader {
+	cr := &checksumReader{r: r, opts: opts, sum: algo.New()}
+	hashes := []io.Writer{cr.sum}
+
+	if opts.ContentMD5 != nil {
+		cr.md5 = md5.New()
+		hashes = append(hashes, cr.md5)
+	}
+
+	if opts.SHA256 != nil {
+		cr.sha256 = sha256.New()
+		hashes = append(hashes, cr.sha256)
+	}
+
+	cr.w = io.MultiWriter(hashes...)
+	return cr
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.w.Write(p[:n])
+	cr.size += int64(n)
+
+	if err == io.EOF && !cr.verify() {
+		return n, errChecksum
+	}
+	return n, err
+}
+
+func (cr *checksumReader) verify() bool {
+	if cr.md5 != nil && !bytes.Equal(cr.md5.Sum(nil), cr.opts.ContentMD5) {
+		return false
+	}
+
+	if cr.sha256 != nil && !bytes.Equal(cr.sha256.Sum(nil), cr.opts.SHA256) {
+		return false
+	}
+
+	return true
+}
+
+// hash returns the checksum of the body as hex.
+func (cr *checksumReader) hash() string {
+	return fmt.Sprintf("%x", cr.sum.Sum(nil))
+}
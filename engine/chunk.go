@@ -0,0 +1,509 @@
+package engine
+
+// chunk.go implements storing large values in chunks. Values larger than the
+// chunk size of the engine are split into chunks of that size, and every chunk
+// is replicated on its own storages, chosen the same way as the storages of a
+// key. A single value doesn't have to fit on a single storage, and reading a
+// large value spreads the load over many storages. The chunks are listed in
+// the entry of the value. Chunked values are always read through the master,
+// which fetches the next chunks in parallel while the current one is streamed
+// to the client. Erasure coded values are not chunked.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+)
+
+// chunkPrefetch is the amount of chunks fetched ahead of the chunk being read.
+const chunkPrefetch = 2
+
+// chunkKey is the key the storages of a chunk are chosen by.
+func chunkKey(key []byte, i int) []byte {
+	k := make([]byte, 0, len(key)+8)
+	k = append(k, key...)
+	k = append(k, 0)
+	return strconv.AppendInt(k, int64(i), 10)
+}
+
+// chunkStorages returns the storages where the i'th chunk of a value belongs.
+func (e *Engine) chunkStorages(key []byte, ent entry.Entry, i int) []string {
+	return entry.KeyToStorage(chunkKey(key, i), e.groupStorages(ent.Group), e.ReplicaCount, e.SubstorageCount)
+}
+
+// shouldChunk reports whether a value of the given size is stored in chunks.
+// The size of values of unknown length is found out only while writing, so
+// they're always chunked.
+func (e *Engine) shouldChunk(ent entry.Entry, size int64) bool {
+	return e.ChunkSize > 0 && !ent.Sharded() && (size < 0 || size > e.ChunkSize)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// removeChunks removes the files of chunks from their storages.
+func (e *Engine) removeChunks(path string, chunks []entry.Chunk) {
+	for i, c := range chunks {
+		for _, s := range c.Storages {
+			if err := e.volume(s).Delete(context.Background(), c.Path(path, i)); err != nil {
+				log.Printf("error cleaning up chunk %d of %s: %s\n", i, path, err)
+			}
+		}
+	}
+}
+
+// writeChunks writes body in chunks, each of them into its own storages. If
+// size is negative, the body is read until its end. Every chunk needs to be
+// acknowledged by quorum storages. It returns the chunks and the storages
+// that are missing a chunk. If the write fails, the written chunks are
+// removed.
+func (e *Engine) writeChunks(key []byte, ent entry.Entry, body io.Reader, size int64, quorum int) ([]entry.Chunk, []string, error) {
+	path := ent.Path(key)
+	br := bufio.NewReader(body)
+
+	chunks := make([]entry.Chunk, 0)
+	missing := make([]string, 0)
+	fail := func(err error) ([]entry.Chunk, []string, error) {
+		e.removeChunks(path, chunks)
+		return nil, nil, err
+	}
+
+	var total int64
+	for i := 0; ; i++ {
+		clen := e.ChunkSize
+		if size >= 0 {
+			if total == size && i > 0 {
+				break
+			}
+
+			if rest := size - total; rest < clen {
+				clen = rest
+			}
+		} else if i > 0 {
+			if _, err := br.Peek(1); err == io.EOF {
+				break
+			} else if err != nil {
+				return fail(err)
+			}
+		}
+
+		// the length of the last chunk is not known if the size isn't.
+		storages := e.chunkStorages(key, ent, i)
+		cr := &countingReader{r: io.LimitReader(br, e.ChunkSize)}
+		if size < 0 {
+			clen = -1
+		}
+
+		written, err := e.writeReplicas(storages, entry.ChunkPath(path, i), cr, clen, quorum)
+		if err != nil {
+			return fail(err)
+		}
+
+		chunks = append(chunks, entry.Chunk{Storages: written, Size: cr.n})
+		total += cr.n
+
+		for _, s := range missingStorages(written, storages) {
+			if len(missingStorages(missing, []string{s})) > 0 {
+				missing = append(missing, s)
+			}
+		}
+	}
+
+	// the rest of the body doesn't fit in the given size.
+	if _, err := br.Peek(1); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("body is longer than content length %d", size)
+		}
+		return fail(err)
+	}
+
+	return chunks, missing, nil
+}
+
+// chunkFetch is a chunk being fetched ahead of reading.
+type chunkFetch struct {
+	done   chan struct{}
+	data   []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+// chunkReader reads a chunked value. The current chunk is streamed from its
+// replicas, while the next chunks are fetched into memory in parallel.
+type chunkReader struct {
+	ctx    context.Context
+	e      *Engine
+	path   string
+	chunks []entry.Chunk
+
+	// starts contains the offset of every chunk in the value.
+	starts []int64
+	size   int64
+
+	offset  int64
+	rc      io.ReadCloser
+	fetches map[int]*chunkFetch
+}
+
+// openChunks opens a reader for a chunked value.
+func (e *Engine) openChunks(ctx context.Context, key []byte, ent entry.Entry) *chunkReader {
+	cr := &chunkReader{
+		ctx:     ctx,
+		e:       e,
+		path:    ent.Path(key),
+		chunks:  ent.Chunks,
+		starts:  make([]int64, len(ent.Chunks)),
+		fetches: make(map[int]*chunkFetch),
+	}
+
+	for i, c := range ent.Chunks {
+		cr.starts[i] = cr.size
+		cr.size += c.Size
+	}
+	return cr
+}
+
+// chunkAt returns the chunk at an offset of the value.
+func (cr *chunkReader) chunkAt(offset int64) int {
+	i := len(cr.starts) - 1
+	for i > 0 && cr.starts[i] > offset {
+		i--
+	}
+	return i
+}
+
+// prefetch starts fetching the i'th chunk.
+func (cr *chunkReader) prefetch(i int) {
+	if _, ok := cr.fetches[i]; ok || i >= len(cr.chunks) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(cr.ctx)
+	f := &chunkFetch{done: make(chan struct{}), cancel: cancel}
+	cr.fetches[i] = f
+
+	go func() {
+		defer close(f.done)
+
+		rr, _ := cr.e.openReplicas(ctx, cr.chunks[i].Storages, cr.chunks[i].Path(cr.path, i), cr.chunks[i].Size, 0)
+		if rr == nil {
+			f.err = errNoReplica
+			return
+		}
+		defer rr.Close()
+
+		f.data = make([]byte, cr.chunks[i].Size)
+		_, f.err = io.ReadFull(rr, f.data)
+	}()
+}
+
+// open opens the chunk at the current offset, and fetches the chunks after it.
+// Fetches outside of the window are cancelled.
+func (cr *chunkReader) open() error {
+	i := cr.chunkAt(cr.offset)
+	for j, f := range cr.fetches {
+		if j < i || j > i+chunkPrefetch {
+			f.cancel()
+			delete(cr.fetches, j)
+		}
+	}
+
+	for j := i + 1; j <= i+chunkPrefetch; j++ {
+		cr.prefetch(j)
+	}
+
+	within := cr.offset - cr.starts[i]
+	if f, ok := cr.fetches[i]; ok {
+		delete(cr.fetches, i)
+		<-f.done
+		f.cancel()
+
+		if f.err == nil {
+			cr.rc = io.NopCloser(bytes.NewReader(f.data[within:]))
+			return nil
+		}
+		log.Printf("chunks: failed fetching chunk %d of %s: %s\n", i, cr.path, f.err)
+	}
+
+	rr, _ := cr.e.openReplicas(cr.ctx, cr.chunks[i].Storages, cr.chunks[i].Path(cr.path, i), cr.chunks[i].Size, within)
+	if rr == nil {
+		return errNoReplica
+	}
+	cr.rc = rr
+	return nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.offset >= cr.size {
+			return 0, io.EOF
+		}
+
+		if cr.rc == nil {
+			if err := cr.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := cr.rc.Read(p)
+		cr.offset += int64(n)
+
+		// continue from the next chunk.
+		if err == io.EOF {
+			cr.rc.Close()
+			cr.rc = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative offset")
+	}
+
+	if offset != cr.offset && cr.rc != nil {
+		cr.rc.Close()
+		cr.rc = nil
+	}
+	cr.offset = offset
+	return offset, nil
+}
+
+func (cr *chunkReader) Close() error {
+	for _, f := range cr.fetches {
+		f.cancel()
+	}
+
+	if cr.rc != nil {
+		return cr.rc.Close()
+	}
+	return nil
+}
+
+// proxyChunks streams a chunked value to the client.
+func (e *Engine) proxyChunks(w http.ResponseWriter, r *http.Request, key []byte, ent entry.Entry, etag string) {
+	cr := e.openChunks(r.Context(), key, ent)
+	defer cr.Close()
+
+	// the first chunk is opened before responding, so that a value that has
+	// lost a chunk is not served partially from the start.
+	if err := cr.open(); err != nil {
+		log.Printf("chunks: cannot read %s: %s\n", key, err)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveValue(w, r, cr, etag)
+}
+
+// moveChunks is moveEntry for chunked values. Every chunk needs to be moved
+// to at least one storage.
+func (e *Engine) moveChunks(key []byte, old, ent entry.Entry) error {
+	from, to := old.Path(key), ent.Path(key)
+
+	chunks := make([]entry.Chunk, 0, len(old.Chunks))
+	missing := make([]string, 0)
+	for i, c := range old.Chunks {
+		moved := entry.Chunk{Storages: make([]string, 0, len(c.Storages)), Size: c.Size}
+		chunks = append(chunks, moved)
+
+		for _, s := range c.Storages {
+			err := e.copyFile(s, c.Path(from, i), entry.ChunkPath(to, i))
+			if errors.Is(err, volume.ErrNotFound) {
+				missing = append(missing, s)
+				continue
+			}
+
+			if err != nil {
+				e.removeChunks(to, chunks)
+				return err
+			}
+			chunks[i].Storages = append(chunks[i].Storages, s)
+		}
+
+		if len(chunks[i].Storages) == 0 {
+			e.removeChunks(to, chunks)
+			return volume.ErrNotFound
+		}
+	}
+
+	ent.Storages = []string{}
+	ent.Chunks = chunks
+	if err := e.switchEntry(key, old, ent); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 && ent.Status == entry.Exists {
+		e.queueRepair(key, missing)
+	}
+	return nil
+}
+
+// repairChunks copies the chunks that belong on storage, but are missing from
+// it, from the other replicas of the chunks.
+func (e *Engine) repairChunks(key []byte, ent entry.Entry, storage string) bool {
+	path := ent.Path(key)
+	ok, changed := true, false
+
+	for i := range ent.Chunks {
+		c := &ent.Chunks[i]
+		chunkPath := c.Path(path, i)
+		chunkStorages := e.chunkStorages(key, ent, i)
+
+		listed := len(missingStorages(c.Storages, []string{storage})) == 0
+		if !listed && len(missingStorages(chunkStorages, []string{storage})) > 0 {
+			continue
+		}
+
+		if listed {
+			ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+			_, err := e.volume(storage).Head(ctx, chunkPath)
+			cancel()
+
+			if err == nil {
+				continue
+			}
+		}
+
+		err := fmt.Errorf("no healthy replica")
+		for _, s := range missingStorages([]string{storage}, c.Storages) {
+			if err = e.copyValue(s, storage, chunkPath); err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			log.Printf("repair: failed copying chunk %d of %s to %s: %s\n", i, key, storage, err)
+			ok = false
+			continue
+		}
+
+		if !listed {
+			c.Storages = orderStorages(append(c.Storages, storage), chunkStorages)
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := e.Put(key, ent); err != nil {
+			log.Printf("repair: failed updating index for %s: %s\n", key, err)
+			ok = false
+		}
+	}
+
+	if !ok {
+		e.counters.repairsFailed.Add(1)
+		return false
+	}
+
+	e.counters.repairs.Add(1)
+	return true
+}
+
+// balanceChunks moves the chunks of a value to the storages where they belong.
+func (e *Engine) balanceChunks(r breq) bool {
+	path := r.ent.Path(r.key)
+	chunks := make([]entry.Chunk, len(r.ent.Chunks))
+	stale := make([][]string, len(r.ent.Chunks))
+	moved := false
+
+	for i, c := range r.ent.Chunks {
+		chunkPath := c.Path(path, i)
+
+		// filter available volumes
+		storages := make([]string, 0, len(c.Storages))
+		for _, s := range c.Storages {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+			_, err := e.volume(s).Head(ctx, chunkPath)
+			cancel()
+
+			if errors.Is(err, volume.ErrNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return false
+			}
+			storages = append(storages, s)
+		}
+
+		if len(storages) == 0 {
+			return false
+		}
+
+		chunkStorages := e.chunkStorages(r.key, r.ent, i)
+		chunks[i] = entry.Chunk{Storages: c.Storages, Size: c.Size, ID: c.ID}
+		if !shouldBalance(storages, chunkStorages) {
+			continue
+		}
+
+		for _, s := range missingStorages(storages, chunkStorages) {
+			var err error
+			for _, from := range storages {
+				if err = e.copyValue(from, s, chunkPath); err == nil {
+					break
+				}
+			}
+
+			if err != nil {
+				log.Printf("error balancing chunk %d of %s: %s\n", i, r.key, err)
+				return false
+			}
+		}
+
+		chunks[i].Storages = chunkStorages
+		stale[i] = missingStorages(chunkStorages, storages)
+		moved = true
+	}
+
+	if !moved {
+		return true
+	}
+
+	r.ent.Chunks = chunks
+	e.balanced(r)
+
+	delErr := false
+	for i, storages := range stale {
+		for _, s := range storages {
+			if err := e.volume(s).Delete(context.Background(), chunks[i].Path(path, i)); err != nil {
+				log.Printf("balance del error: %s\n", err)
+				delErr = true
+			}
+		}
+	}
+
+	return !delErr
+}
@@ -0,0 +1,104 @@
+package engine
+
+// conditional.go implements conditional requests. The etag of a value is its
+// stored checksum, so clients can check whether a value has changed without
+// reading it, and writes and deletes can be made conditional on the current
+// value. If-None-Match: * on a write only creates the key if it doesn't exist.
+// The modification time conditions are used only without the etag conditions
+// and for values whose modification time is known.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+)
+
+// etag returns the etag of an entry or an empty string if the entry doesn't
+// have a checksum, for example because it was rebuilt from the storages.
+// Values with an etag of their own, like completed multipart uploads, use it
+// instead of the checksum.
+func etag(ent entry.Entry) string {
+	if ent.ETag != "" {
+		return fmt.Sprintf("%q", ent.ETag)
+	}
+
+	if ent.Hash == "" {
+		return ""
+	}
+	return fmt.Sprintf("%q", ent.Hash)
+}
+
+// matchEtag reports whether the etag list of an If-Match or If-None-Match
+// header matches the entry. Weak etags only match when weak is set.
+func matchEtag(header string, ent entry.Entry, weak bool) bool {
+	if ent.Status != entry.Exists {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	tag := etag(ent)
+	if tag == "" {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionTime parses a time condition header. It's ignored if the
+// modification time of the value is not known.
+func conditionTime(r *http.Request, header string, ent entry.Entry) (time.Time, bool) {
+	h := r.Header.Get(header)
+	if h == "" || ent.Status != entry.Exists || ent.Modified.IsZero() {
+		return time.Time{}, false
+	}
+
+	t, err := http.ParseTime(h)
+	return t, err == nil
+}
+
+// checkConditions evaluates the conditional headers of a request against the
+// current value. It returns zero if the request can proceed and
+// otherwise the status code to respond with.
+func checkConditions(r *http.Request, ent entry.Entry) int {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// times in http headers only have a precision of a second.
+	modified := ent.Modified.Truncate(time.Second)
+
+	if h := r.Header.Get("If-Match"); h != "" {
+		if !matchEtag(h, ent, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := conditionTime(r, "If-Unmodified-Since", ent); ok && modified.After(t) {
+		return http.StatusPreconditionFailed
+	}
+
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		if matchEtag(h, ent, true) {
+			if read {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := conditionTime(r, "If-Modified-Since", ent); ok && read && !modified.After(t) {
+		return http.StatusNotModified
+	}
+
+	return 0
+}
@@ -0,0 +1,221 @@
+package engine
+
+// dedup.go implements content addressed deduplication of replicated values.
+// The value is first written into the path of its key like any other value.
+// Once the checksum is known, the value is moved into a blob whose path is
+// derived from the checksum, see entry.BlobPath. If the blob already exists,
+// the written files are dropped and the value points to the existing blob.
+//
+// The index has a record for every blob with a reference count and the
+// storages holding the blob. Every value pointing to the blob holds a
+// reference, including old versions and values in the trash, and the files
+// are removed once the last reference is released. The storages in the
+// entries of deduplicated values are replaced with the storages of the blob
+// when reading, so that repairing or balancing the blob through one key is
+// seen by the rest.
+//
+// The blobs don't contain the keys, so deduplicated values can't be rebuilt
+// into the index from the storages.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// blobLockWait is how long a write or delete waits for the record of a blob
+// to be released by another one.
+const blobLockWait = 10 * time.Second
+
+// blobPrefix is the key namespace of the blob records.
+var blobPrefix = []byte("blob:")
+
+// blobRecord is the record of a blob shared by deduplicated values.
+type blobRecord struct {
+	Refs     int      `json:"refs"`
+	Storages []string `json:"storages"`
+	Size     int64    `json:"size"`
+}
+
+func blobKey(path string) []byte {
+	k := make([]byte, 0, len(blobPrefix)+len(path))
+	k = append(k, blobPrefix...)
+	return append(k, path...)
+}
+
+func (e *Engine) getBlob(path string) (*blobRecord, error) {
+	b, err := e.DB.Get(blobKey(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec blobRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (e *Engine) putBlob(path string, rec *blobRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return e.DB.Put(blobKey(path), b, nil)
+}
+
+// lockBlob locks the record of the blob at path and returns the function
+// releasing the lock.
+func (e *Engine) lockBlob(path string) (func(), error) {
+	lock := string(blobKey(path))
+	if err := e.lockKeyWait(lock, blobLockWait); err != nil {
+		return nil, err
+	}
+	return func() { e.RemoveLock(lock) }, nil
+}
+
+// shouldDedup reports whether a value written with the entry is
+// deduplicated. Erasure coded and chunked values have files of their own.
+func (e *Engine) shouldDedup(ent entry.Entry, chunked bool) bool {
+	return e.Dedup && !ent.Sharded() && !chunked
+}
+
+// blobEntry fills in the storages of a deduplicated value from its blob.
+func (e *Engine) blobEntry(key []byte, ent entry.Entry) entry.Entry {
+	if !ent.Dedup {
+		return ent
+	}
+
+	if rec, err := e.getBlob(ent.Path(key)); err == nil {
+		ent.Storages = rec.Storages
+	}
+	return ent
+}
+
+// dedup moves a value written into the path of key on the written storages
+// into its blob and returns the entry pointing to the blob. The files in the
+// path of key are removed either way.
+func (e *Engine) dedup(key []byte, ent entry.Entry, written []string) (entry.Entry, error) {
+	from := ent.Path(key)
+	defer func() {
+		for _, s := range written {
+			if err := e.volume(s).Delete(context.Background(), from); err != nil {
+				log.Printf("dedup: failed deleting %s from %s: %s\n", key, s, err)
+			}
+		}
+	}()
+
+	ent.Dedup = true
+	path := ent.Path(key)
+	unlock, err := e.lockBlob(path)
+	if err != nil {
+		return ent, err
+	}
+	defer unlock()
+
+	rec, err := e.getBlob(path)
+	switch {
+	case err == nil:
+		rec.Refs++
+	case errors.Is(err, leveldb.ErrNotFound):
+		// the blob is created on the storages that have the value. Balancing
+		// moves it to the storages where it belongs.
+		rec = &blobRecord{Refs: 1, Storages: []string{}, Size: ent.Size}
+		for _, s := range written {
+			if err := e.copyFile(s, from, path); err != nil {
+				log.Printf("dedup: failed copying %s on %s: %s\n", key, s, err)
+				continue
+			}
+			rec.Storages = append(rec.Storages, s)
+		}
+
+		if len(rec.Storages) == 0 {
+			return ent, errors.New("no storage has the value")
+		}
+	default:
+		return ent, err
+	}
+
+	if err := e.putBlob(path, rec); err != nil {
+		return ent, err
+	}
+
+	ent.Storages = rec.Storages
+	return ent, nil
+}
+
+// setBlobStorages stores the storages of the blob of a deduplicated value
+// after it has been repaired or balanced.
+func (e *Engine) setBlobStorages(key []byte, ent entry.Entry) error {
+	path := ent.Path(key)
+	unlock, err := e.lockBlob(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// a blob that was released meanwhile stays removed.
+	rec, err := e.getBlob(path)
+	if err != nil {
+		return err
+	}
+
+	rec.Storages = ent.Storages
+	return e.putBlob(path, rec)
+}
+
+// releaseBlob releases a reference to the blob at path. The files of the blob
+// are removed with the last reference. If removing them fails, the reference
+// is kept, so that releasing can be retried.
+func (e *Engine) releaseBlob(path string) error {
+	unlock, err := e.lockBlob(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rec, err := e.getBlob(path)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if rec.Refs > 1 {
+		rec.Refs--
+		return e.putBlob(path, rec)
+	}
+
+	// a retry may find the blob already removed from some of the storages.
+	for _, s := range rec.Storages {
+		err := e.volume(s).Delete(context.Background(), path)
+		if err != nil && !errors.Is(err, volume.ErrNotFound) {
+			return err
+		}
+	}
+	return e.DB.Delete(blobKey(path), nil)
+}
+
+// removeValue removes the files of the value of an entry. Deduplicated values
+// release their blob instead.
+func (e *Engine) removeValue(key []byte, ent entry.Entry) error {
+	if ent.Dedup {
+		return e.releaseBlob(ent.Path(key))
+	}
+
+	var err error
+	for _, f := range entryFiles(key, ent) {
+		if ferr := e.volume(f.storage).Delete(context.Background(), f.path); ferr != nil {
+			err = ferr
+		}
+	}
+	return err
+}
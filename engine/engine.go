@@ -2,12 +2,21 @@ package engine
 
 import (
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// objectRange is the range of the index that contains the object entries.
+// Object keys are url paths, so they always begin with a slash. The rest of
+// the index is used for internal bookkeeping such as the repair queue.
+var objectRange = util.BytesPrefix([]byte("/"))
+
 type Engine struct {
 	DB              *leveldb.DB
 	mu              sync.Mutex
@@ -15,6 +24,69 @@ type Engine struct {
 	Storages        []string
 	ReplicaCount    int
 	SubstorageCount int
+
+	// StallTimeout is the time after which a write is aborted if a storage
+	// server hasn't consumed any data.
+	StallTimeout time.Duration
+
+	// WriteQuorum is the amount of storages that need to acknowledge a write.
+	// If zero, every replica needs to acknowledge the write.
+	WriteQuorum int
+
+	// ReadQuorum is the amount of storages that need to have a value for it to
+	// be readable. If zero, a single storage is enough.
+	ReadQuorum int
+
+	// ReadMode is either ReadModeRedirect or ReadModeProxy.
+	ReadMode string
+
+	// Versioning makes every write create a new version of the key instead
+	// of failing if the key already exists. See version.go.
+	Versioning bool
+
+	// HashAlgo is the algorithm of the checksums computed for new values.
+	HashAlgo entry.HashAlgo
+
+	// GCDelay is how long the files of an overwritten value are kept for
+	// reads that are still using them.
+	GCDelay time.Duration
+
+	// Groups are named groups of storages in addition to the default
+	// Storages. Values are moved between the groups by the lifecycle rules,
+	// see lifecycle.go.
+	Groups map[string][]string
+
+	// Lifecycle is the lifecycle configuration applied by ApplyLifecycle.
+	Lifecycle *Lifecycle
+
+	// AuditLog receives a line for every action taken by the lifecycle
+	// rules. If nil, the actions are logged.
+	AuditLog io.Writer
+
+	// TrashRetention is how long deleted values are kept in the trash. If
+	// zero, deletes remove values right away. See trash.go.
+	TrashRetention time.Duration
+
+	// DataShards and ParityShards enable erasure coding of new values instead
+	// of replicating them, see erasure.go. Zero DataShards disables erasure
+	// coding.
+	DataShards   int
+	ParityShards int
+
+	// ChunkSize is the size of the chunks of values stored in chunks. Values
+	// larger than it are chunked, see chunk.go. Zero disables chunking.
+	ChunkSize int64
+
+	// UploadExpiry is how long unfinished multipart uploads are kept before
+	// they're aborted, see upload.go. Zero keeps them until they're finished.
+	UploadExpiry time.Duration
+
+	// Dedup stores replicated values with the same content only once, see
+	// dedup.go. The checksums of HashAlgo identify the content, so it should
+	// be collision resistant.
+	Dedup bool
+
+	counters counters
 }
 
 func (e *Engine) LockKey(key string) error {
@@ -28,6 +100,19 @@ func (e *Engine) LockKey(key string) error {
 	return nil
 }
 
+// lockKeyWait is like LockKey, but waits for the lock to be released if the key
+// is already locked.
+func (e *Engine) lockKeyWait(key string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := e.LockKey(key)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (e *Engine) RemoveLock(key string) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -47,7 +132,37 @@ func (e *Engine) Get(key []byte) entry.Entry {
 	}
 
 	en = entry.EntryFromBytes(b)
-	return en
+	return e.blobEntry(key, en)
+}
+
+// groupStorages returns the storages of a group. Unknown groups use the
+// default storages.
+func (e *Engine) groupStorages(group string) []string {
+	if storages, ok := e.Groups[group]; ok && group != "" {
+		return storages
+	}
+	return e.Storages
+}
+
+// keyStorages returns the storages where the value of an entry belongs. The
+// entry decides the group and whether the value is replicated or erasure
+// coded. The shards of an erasure coded value are in the order of the
+// storages. Deduplicated values belong where their blob does.
+func (e *Engine) keyStorages(key []byte, ent entry.Entry) []string {
+	count := e.ReplicaCount
+	if ent.Sharded() {
+		count = ent.DataShards + ent.ParityShards
+	}
+
+	if ent.Dedup {
+		key = []byte(ent.Path(key))
+	}
+	return entry.KeyToStorage(key, e.groupStorages(ent.Group), count, e.SubstorageCount)
+}
+
+// volume returns the volume of a storage.
+func (e *Engine) volume(storage string) volume.Volume {
+	return volume.Open(storage)
 }
 
 func NewEngine() *Engine {
@@ -0,0 +1,2077 @@
+package engine_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nireo/jakaja/engine"
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/zeebo/blake3"
+)
+
+// newEngine creates an engine with an in-memory index and in-memory volumes
+// that are unique to the test.
+func newEngine(t *testing.T) *engine.Engine {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	storages := make([]string, 3)
+	for i := range storages {
+		storages[i] = fmt.Sprintf("mem://%s-%d", t.Name(), i)
+	}
+
+	return &engine.Engine{
+		DB:              db,
+		Keylocks:        make(map[string]struct{}),
+		Storages:        storages,
+		ReplicaCount:    2,
+		SubstorageCount: 1,
+	}
+}
+
+// volumeServers starts n volume servers and returns their addresses.
+func volumeServers(t *testing.T, n int) []string {
+	storages := make([]string, n)
+	for i := range storages {
+		s := httptest.NewServer(volume.NewServer(t.TempDir()))
+		t.Cleanup(s.Close)
+		storages[i] = s.URL
+	}
+	return storages
+}
+
+// storageServer is a volume server that records the methods of the requests
+// it gets and reports a content type for the files, like nginx does.
+type storageServer struct {
+	h           http.Handler
+	contentType string
+
+	// received is the amount of bytes read from the bodies of the requests.
+	received atomic.Int64
+
+	// failAfter makes the reads of whole files fail after the given amount of
+	// bytes, if it's set.
+	failAfter atomic.Int64
+
+	mu      sync.Mutex
+	methods []string
+}
+
+func newStorageServer(t *testing.T, contentType string) (*storageServer, string) {
+	s := &storageServer{h: volume.NewServer(t.TempDir()), contentType: contentType}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func (s *storageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.methods = append(s.methods, r.Method)
+	s.mu.Unlock()
+
+	if n := s.failAfter.Load(); n > 0 && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		w = &failingWriter{ResponseWriter: w, left: n}
+	}
+
+	r.Body = countingBody{r.Body, &s.received}
+	s.h.ServeHTTP(typedWriter{w, s.contentType}, r)
+}
+
+// requests returns the methods of the requests since the last call.
+func (s *storageServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	methods := s.methods
+	s.methods = nil
+	return methods
+}
+
+// failingWriter aborts the response once left bytes have been written.
+type failingWriter struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.left {
+		w.left -= int64(len(p))
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.ResponseWriter.Write(p[:w.left])
+	w.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// typedWriter replaces the content type of the files served by a volume
+// server.
+type typedWriter struct {
+	http.ResponseWriter
+	contentType string
+}
+
+func (w typedWriter) WriteHeader(code int) {
+	if w.contentType != "" && w.Header().Get("Content-Type") == "application/octet-stream" {
+		w.Header().Set("Content-Type", w.contentType)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func request(e *engine.Engine, method, url, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(method, url, r))
+	return w
+}
+
+func Test_putGetDelete(t *testing.T) {
+	e := newEngine(t)
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusForbidden {
+		t.Fatalf("second put: got status %d", w.Code)
+	}
+
+	w := request(e, http.MethodGet, "/key", "")
+	if w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: got status %d", w.Code)
+	}
+}
+
+func Test_list(t *testing.T) {
+	e := newEngine(t)
+
+	for _, k := range []string{"/a", "/dir/b", "/dir/c", "/e"} {
+		if w := request(e, http.MethodPut, k, "value"); w.Code != http.StatusCreated {
+			t.Fatalf("put %s: got status %d", k, w.Code)
+		}
+	}
+
+	res := e.List("/", "", "/", 2)
+	if len(res.Keys) != 1 || res.Keys[0].Key != "/a" ||
+		len(res.Prefixes) != 1 || res.Prefixes[0] != "/dir/" || res.Next != "/e" {
+		t.Fatalf("unexpected first page: %+v", res)
+	}
+
+	res = e.List("/", res.Next, "/", 2)
+	if len(res.Keys) != 1 || res.Keys[0].Key != "/e" || res.Next != "" {
+		t.Fatalf("unexpected second page: %+v", res)
+	}
+
+	// prefixes containing only deleted keys are not listed.
+	for _, k := range []string{"/dir/b", "/dir/c"} {
+		if w := request(e, http.MethodDelete, k, ""); w.Code != http.StatusNoContent {
+			t.Fatalf("delete %s: got status %d", k, w.Code)
+		}
+	}
+
+	deleted := (&entry.Entry{Storages: []string{}, Status: entry.SoftDeleted}).ToBytes()
+	e.DB.Put([]byte("/gone/f"), deleted, nil)
+
+	res = e.List("/", "", "/", 10)
+	if len(res.Keys) != 2 || len(res.Prefixes) != 0 {
+		t.Fatalf("unexpected listing after deleting: %+v", res)
+	}
+
+	// the next page starts at a live key, and there is none if only deleted
+	// keys are left.
+	e.DB.Put([]byte("/b"), deleted, nil)
+
+	res = e.List("/", "", "", 1)
+	if len(res.Keys) != 1 || res.Keys[0].Key != "/a" || res.Next != "/e" {
+		t.Fatalf("unexpected page before a deleted key: %+v", res)
+	}
+
+	res = e.List("/", res.Next, "", 1)
+	if len(res.Keys) != 1 || res.Keys[0].Key != "/e" || res.Next != "" {
+		t.Fatalf("unexpected page before only deleted keys: %+v", res)
+	}
+
+	w := request(e, http.MethodGet, "/?list&prefix=/d&delimiter=/", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"keys":[]`) {
+		t.Fatalf("list request: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := request(e, http.MethodGet, "/?list&limit=-1", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("list with invalid limit: got status %d", w.Code)
+	}
+}
+
+func Test_stream(t *testing.T) {
+	e := newEngine(t)
+	s, addr := newStorageServer(t, "")
+	e.Storages, e.ReplicaCount = []string{addr}, 1
+
+	// the storages receive the body while it's still being read.
+	half := bytes.Repeat([]byte("a"), 1<<20)
+	streamed := make(chan bool, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(half)
+		deadline := time.Now().Add(5 * time.Second)
+		for s.received.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		streamed <- s.received.Load() > 0
+		pw.Write(half)
+		pw.Close()
+	}()
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/big", pr))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	if !<-streamed {
+		t.Fatal("put: the body was buffered before writing it")
+	}
+
+	e.ReadMode = engine.ReadModeProxy
+	if w := request(e, http.MethodGet, "/big", ""); w.Code != http.StatusOK || w.Body.Len() != 2*len(half) {
+		t.Fatalf("get: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// a storage that stops reading the body fails the write after the stall
+	// timeout instead of blocking it.
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		r.Body.Read(make([]byte, 1))
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+
+	e.Storages, e.ReplicaCount = []string{addr, stalled.URL}, 2
+	e.StallTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if w := request(e, http.MethodPut, "/stalled", strings.Repeat("a", 16<<20)); w.Code != http.StatusInternalServerError {
+		t.Fatalf("stalled put: got status %d", w.Code)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("stalled put: took %s", time.Since(start))
+	}
+
+	if w := request(e, http.MethodGet, "/stalled", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after stalled put: got status %d", w.Code)
+	}
+}
+
+func Test_proxy(t *testing.T) {
+	e := newEngine(t)
+	s, addr := newStorageServer(t, "text/plain")
+	e.Storages, e.ReplicaCount = []string{addr}, 1
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	// by default reads are redirected to the storages.
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusMovedPermanently || !strings.HasPrefix(w.Header().Get("Location"), addr+"/") {
+		t.Fatalf("redirect: got status %d and location %s", w.Code, w.Header().Get("Location"))
+	}
+	e.ReadMode = engine.ReadModeProxy
+	s.requests()
+
+	// values have the content type of the storage, and are read with a single
+	// request.
+	w := request(e, http.MethodGet, "/key", "")
+	if w.Code != http.StatusOK || w.Body.String() != "value" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("get: got status %d, content type %s and body %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	if methods := s.requests(); len(methods) != 1 || methods[0] != http.MethodGet {
+		t.Fatalf("get: got storage requests %v", methods)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+	r.Header.Set("Range", "bytes=1-3")
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "alu" {
+		t.Fatalf("range: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if methods := s.requests(); len(methods) != 1 || methods[0] != http.MethodGet {
+		t.Fatalf("range: got storage requests %v", methods)
+	}
+
+	// reads that fail midway are continued from another storage.
+	other, otherAddr := newStorageServer(t, "text/plain")
+	e.Storages, e.ReplicaCount = []string{addr, otherAddr}, 2
+
+	value := strings.Repeat("0123456789", 10000)
+	if w := request(e, http.MethodPut, "/big", value); w.Code != http.StatusCreated {
+		t.Fatalf("put big: got status %d", w.Code)
+	}
+	s.requests()
+	other.requests()
+	s.failAfter.Store(int64(len(value) / 2))
+	other.failAfter.Store(int64(len(value) / 2))
+
+	if w := request(e, http.MethodGet, "/big", ""); w.Code != http.StatusOK || w.Body.String() != value {
+		t.Fatalf("get big: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	if n := len(s.requests()) + len(other.requests()); n != 2 {
+		t.Fatalf("get big: got %d storage requests", n)
+	}
+}
+
+func Test_quorum(t *testing.T) {
+	e := newEngine(t)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	e.Storages[2], e.ReplicaCount = dead.URL, 3
+	e.ReadMode = engine.ReadModeProxy
+
+	withQuorum := func(method, url, body, header, quorum string) *httptest.ResponseRecorder {
+		var b io.Reader
+		if body != "" {
+			b = strings.NewReader(body)
+		}
+
+		r := httptest.NewRequest(method, url, b)
+		r.Header.Set(header, quorum)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	// by default every replica has to be written.
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	for _, q := range []string{"0", "4", "x"} {
+		if w := withQuorum(http.MethodPut, "/key", "value", "X-Jakaja-Write-Quorum", q); w.Code != http.StatusBadRequest {
+			t.Fatalf("put with write quorum %s: got status %d", q, w.Code)
+		}
+	}
+
+	if w := withQuorum(http.MethodPut, "/key", "value", "X-Jakaja-Write-Quorum", "2"); w.Code != http.StatusCreated {
+		t.Fatalf("put with write quorum 2: got status %d", w.Code)
+	}
+
+	e.WriteQuorum = 2
+	if w := request(e, http.MethodPut, "/other", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put with default write quorum 2: got status %d", w.Code)
+	}
+
+	// only the storages that acknowledged the write are in the entry.
+	ent := e.Get([]byte("/key"))
+	if len(ent.Storages) != 2 {
+		t.Fatalf("unexpected storages %v", ent.Storages)
+	}
+
+	if w := withQuorum(http.MethodGet, "/key", "", "X-Jakaja-Read-Quorum", "2"); w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get with read quorum 2: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := withQuorum(http.MethodGet, "/key", "", "X-Jakaja-Read-Quorum", "0"); w.Code != http.StatusBadRequest {
+		t.Fatalf("get with read quorum 0: got status %d", w.Code)
+	}
+
+	if err := volume.Open(ent.Storages[0]).Delete(context.Background(), entry.HashKey([]byte("/key"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := withQuorum(http.MethodGet, "/key", "", "X-Jakaja-Read-Quorum", "2"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("get with read quorum 2 and a lost replica: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get with a lost replica: got status %d and body %q", w.Code, w.Body.String())
+	}
+}
+
+func Test_repair(t *testing.T) {
+	e := newEngine(t)
+
+	// the last storage refuses writes until it's back up.
+	var down atomic.Bool
+	down.Store(true)
+	vs := volume.NewServer(t.TempDir())
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() && r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		vs.ServeHTTP(w, r)
+	}))
+	t.Cleanup(flaky.Close)
+	e.Storages[2], e.ReplicaCount, e.WriteQuorum = flaky.URL, 3, 2
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	// the missing replica is queued in the index, so the queue survives
+	// restarts.
+	queued := func() map[string]interface{} {
+		it := e.DB.NewIterator(util.BytesPrefix([]byte("repair:")), nil)
+		defer it.Release()
+
+		var item map[string]interface{}
+		for it.Next() {
+			if item != nil {
+				t.Fatal("more than one queued repair")
+			}
+			if err := json.Unmarshal(it.Value(), &item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return item
+	}
+
+	item := queued()
+	if item == nil || item["storage"] != flaky.URL || item["key"] != "/key" {
+		t.Fatalf("unexpected queued repair %v", item)
+	}
+
+	// a key that is in use is not a failed attempt.
+	if err := e.LockKey("/key"); err != nil {
+		t.Fatal(err)
+	}
+	e.Repair()
+	e.RemoveLock("/key")
+
+	if item := queued(); item["attempts"] != 0.0 {
+		t.Fatalf("locked key was counted as a failed repair: %v", item)
+	}
+
+	// failed repairs are retried with a backoff.
+	e.Repair()
+	item = queued()
+	next, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(item["next"]))
+	if item["attempts"] != 1.0 || !next.After(time.Now()) {
+		t.Fatalf("unexpected queued repair after a failure %v", item)
+	}
+
+	e.Repair()
+	if item := queued(); item["attempts"] != 1.0 {
+		t.Fatalf("repair was retried before the backoff: %v", item)
+	}
+
+	// once the storage is back and the backoff has passed, the value is copied
+	// and the storage is added to the entry.
+	down.Store(false)
+	item["next"] = time.Now().Add(-time.Second)
+	b, _ := json.Marshal(item)
+	if err := e.DB.Put([]byte("repair:/key\x00"+flaky.URL), b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Repair()
+	if item := queued(); item != nil {
+		t.Fatalf("repair is still queued: %v", item)
+	}
+
+	if ent := e.Get([]byte("/key")); len(ent.Storages) != 3 {
+		t.Fatalf("unexpected storages after repair %v", ent.Storages)
+	}
+
+	if _, err := volume.Open(flaky.URL).Head(context.Background(), entry.HashKey([]byte("/key"))); err != nil {
+		t.Fatalf("repaired replica: %s", err)
+	}
+}
+
+func Test_readRepair(t *testing.T) {
+	e := newEngine(t)
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	ent := e.Get([]byte("/key"))
+	path := entry.HashKey([]byte("/key"))
+	lost := volume.Open(ent.Storages[0])
+	if err := lost.Delete(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := func() engine.Stats {
+		var stats engine.Stats
+		if err := json.Unmarshal(request(e, http.MethodGet, "/?stats", "").Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	// a read that notices the lost replica repairs it in the background.
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+	r.Header.Set("X-Jakaja-Read-Quorum", "2")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("get: got status %d", w.Code)
+	}
+
+	if s := stats(); s.ReadRepairs != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Repairs == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := lost.Head(context.Background(), path); err != nil {
+		t.Fatalf("read repair: %s", err)
+	}
+
+	e.ReadMode = engine.ReadModeProxy
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get after repair: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// values lost from every replica cannot be repaired.
+	for _, s := range ent.Storages {
+		if err := volume.Open(s).Delete(context.Background(), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get lost value: got status %d", w.Code)
+	}
+
+	if s := stats(); s.ReadRepairs != 1 || s.Repairs != 1 {
+		t.Fatalf("unexpected stats after losing every replica %+v", s)
+	}
+}
+
+func Test_verify(t *testing.T) {
+	e := newEngine(t)
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+	ent := e.Get([]byte("/key"))
+	path := entry.HashKey([]byte("/key"))
+
+	corrupt := volume.Open(ent.Storages[0])
+	if err := corrupt.Put(context.Background(), path, strings.NewReader("VALUE"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); report.Keys != 1 || report.Corrupt != 1 || report.Repaired != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{Repair: true}); report.Corrupt != 1 || report.Repaired != 1 {
+		t.Fatalf("unexpected report with repair: %+v", report)
+	}
+
+	rc, err := corrupt.Get(context.Background(), path, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "value" {
+		t.Fatalf("corrupt replica was not repaired: %q", b)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() {
+		t.Fatalf("unexpected report after repair: %+v", report)
+	}
+
+	// slow verifications don't block writes, and values written meanwhile
+	// are not repaired with the old value.
+	if err := corrupt.Put(context.Background(), path, strings.NewReader("VALUE"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan engine.VerifyReport)
+	go func() { done <- e.Verify(engine.VerifyOptions{Rate: 20, Repair: true}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	if e.LockKey("/key") != nil {
+		t.Fatal("verify holds the lock while reading")
+	}
+	e.RemoveLock("/key")
+
+	request(e, http.MethodDelete, "/key", "")
+	if report := <-done; report.Corrupt != 1 || report.Repaired != 0 {
+		t.Fatalf("unexpected report of a deleted key: %+v", report)
+	}
+
+	if _, err := corrupt.Head(context.Background(), path); !errors.Is(err, volume.ErrNotFound) {
+		t.Fatalf("deleted value was repaired: %v", err)
+	}
+}
+
+func Test_scrub(t *testing.T) {
+	e := newEngine(t)
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+	ent := e.Get([]byte("/key"))
+	path := entry.HashKey([]byte("/key"))
+
+	lost := volume.Open(ent.Storages[0])
+	if err := lost.Delete(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); report.Keys != 1 || report.Missing != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// the scrubber counts the keys and the problems it has found.
+	go e.ScrubWorker(100*time.Millisecond, engine.VerifyOptions{Repair: true})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().ScrubbedKeys == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s := e.Stats(); s.ScrubbedKeys != 1 || s.ScrubErrors != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	if _, err := lost.Head(context.Background(), path); err != nil {
+		t.Fatalf("scrub did not repair the lost replica: %s", err)
+	}
+}
+
+func Test_build(t *testing.T) {
+	// the index is rebuilt from in-memory volumes and from volume servers,
+	// which list their directories like nginx does.
+	for _, storages := range [][]string{nil, volumeServers(t, 3)} {
+		e := newEngine(t)
+		if storages != nil {
+			e.Storages = storages
+		}
+		e.ReadMode = engine.ReadModeProxy
+
+		if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+			t.Fatalf("put: got status %d", w.Code)
+		}
+		before := e.Get([]byte("/key"))
+
+		e.Build()
+
+		after := e.Get([]byte("/key"))
+		if strings.Join(before.Storages, ",") != strings.Join(after.Storages, ",") {
+			t.Fatalf("storages differ after build: %v != %v", before.Storages, after.Storages)
+		}
+
+		w := request(e, http.MethodGet, "/key", "")
+		if w.Code != http.StatusOK || w.Body.String() != "value" {
+			t.Fatalf("get after build: got status %d and body %q", w.Code, w.Body.String())
+		}
+	}
+}
+
+func Test_versioning(t *testing.T) {
+	e := newEngine(t)
+	e.Versioning = true
+
+	get := func(url, want string) {
+		t.Helper()
+		w := request(e, http.MethodGet, url, "")
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Fatalf("get %s: got status %d and body %q", url, w.Code, w.Body.String())
+		}
+	}
+
+	versions := make([]string, 0)
+	for _, v := range []string{"first", "second"} {
+		w := request(e, http.MethodPut, "/key", v)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("put %s: got status %d", v, w.Code)
+		}
+		versions = append(versions, w.Header().Get("X-Jakaja-Version-Id"))
+	}
+
+	get("/key", "second")
+	get("/key?versionId="+versions[0], "first")
+
+	var listed []engine.Version
+	w := request(e, http.MethodGet, "/key?versions", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].VersionID != versions[1] || !listed[0].Latest {
+		t.Fatalf("unexpected versions: %+v", listed)
+	}
+
+	// deleting creates a delete marker, which can be removed to undo the
+	// delete.
+	w = request(e, http.MethodDelete, "/key", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+	marker := w.Header().Get("X-Jakaja-Version-Id")
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: got status %d", w.Code)
+	}
+	get("/key?versionId="+versions[0], "first")
+
+	if w := request(e, http.MethodDelete, "/key?versionId="+marker, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete marker: got status %d", w.Code)
+	}
+	get("/key", "second")
+
+	if w := request(e, http.MethodPost, "/key?restore&versionId="+versions[0], ""); w.Code != http.StatusCreated {
+		t.Fatalf("restore: got status %d", w.Code)
+	}
+	get("/key", "first")
+
+	e.Build()
+	get("/key", "first")
+	get("/key?versionId="+versions[1], "second")
+}
+
+func Test_overwrite(t *testing.T) {
+	e := newEngine(t)
+	e.GCDelay = time.Nanosecond
+
+	if w := request(e, http.MethodPut, "/key", "first"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+	old := e.Get([]byte("/key"))
+
+	// reads aren't blocked by a write in progress.
+	if err := e.LockKey("/key"); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != "first" {
+		t.Fatalf("get during write: got status %d and body %q", w.Code, w.Body.String())
+	}
+	e.RemoveLock("/key")
+
+	r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("second"))
+	r.Header.Set("X-Jakaja-Overwrite", "true")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Jakaja-Version-Id") != "" {
+		t.Fatalf("overwrite: got status %d and headers %v", w.Code, w.Header())
+	}
+
+	w = request(e, http.MethodGet, "/key", "")
+	if w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Fatalf("get: got status %d and body %q", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("Etag")
+
+	for _, tc := range []struct {
+		ifMatch string
+		status  int
+	}{
+		{`"0123456789abcdef0123456789abcdef"`, http.StatusPreconditionFailed},
+		{etag, http.StatusCreated},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("third"))
+		r.Header.Set("If-Match", tc.ifMatch)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("put with If-Match %s: got status %d", tc.ifMatch, w.Code)
+		}
+	}
+
+	// the paths of the overwrites are not rebuilt into versions, and the
+	// newest value wins over the replaced ones.
+	e.Build()
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != "third" {
+		t.Fatalf("get after build: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	it := e.DB.NewIterator(nil, nil)
+	for it.Next() {
+		if bytes.HasPrefix(it.Key(), []byte("ver:")) {
+			t.Fatalf("build: overwrite rebuilt into version %q", it.Key())
+		}
+	}
+	it.Release()
+
+	// the replaced files are removed once they are due.
+	time.Sleep(time.Millisecond)
+	e.CollectGarbage()
+	for _, s := range old.Storages {
+		_, err := volume.Open(s).Head(context.Background(), old.Path([]byte("/key")))
+		if !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("old value on %s was not removed: %v", s, err)
+		}
+	}
+}
+
+func Test_conditional(t *testing.T) {
+	e := newEngine(t)
+
+	conditional := func(method, header, value string) int {
+		var body io.Reader
+		if method == http.MethodPut {
+			body = strings.NewReader("value")
+		}
+
+		r := httptest.NewRequest(method, "/key", body)
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := conditional(http.MethodPut, "If-None-Match", "*"); code != http.StatusCreated {
+		t.Fatalf("create only put: got status %d", code)
+	}
+
+	if code := conditional(http.MethodPut, "If-None-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Fatalf("create only put on existing key: got status %d", code)
+	}
+
+	etag := request(e, http.MethodHead, "/key", "").Header().Get("Etag")
+	if etag == "" {
+		t.Fatal("no etag")
+	}
+
+	for _, tc := range []struct {
+		method string
+		header string
+		value  string
+		status int
+	}{
+		{http.MethodGet, "If-None-Match", etag, http.StatusNotModified},
+		{http.MethodHead, "If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", `"other"`, http.StatusOK},
+		{http.MethodGet, "If-Match", `"other"`, http.StatusPreconditionFailed},
+		{http.MethodDelete, "If-Match", `"other"`, http.StatusPreconditionFailed},
+		{http.MethodDelete, "If-None-Match", etag, http.StatusPreconditionFailed},
+		{http.MethodDelete, "If-Match", etag, http.StatusNoContent},
+	} {
+		if code := conditional(tc.method, tc.header, tc.value); code != tc.status {
+			t.Fatalf("%s with %s: %s: got status %d, want %d", tc.method, tc.header, tc.value, code, tc.status)
+		}
+	}
+}
+
+func Test_checksum(t *testing.T) {
+	e := newEngine(t)
+
+	put := func(key, header, value string) int {
+		r := httptest.NewRequest(http.MethodPut, key, strings.NewReader("value"))
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	md5sum := md5.Sum([]byte("value"))
+	if code := put("/md5", "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:])); code != http.StatusCreated {
+		t.Fatalf("put with content md5: got status %d", code)
+	}
+
+	shasum := sha256.Sum256([]byte("value"))
+	if code := put("/sha256", "X-Jakaja-Checksum-SHA256", hex.EncodeToString(shasum[:])); code != http.StatusCreated {
+		t.Fatalf("put with sha256: got status %d", code)
+	}
+
+	if code := put("/invalid", "Content-MD5", "invalid"); code != http.StatusBadRequest {
+		t.Fatalf("put with invalid content md5: got status %d", code)
+	}
+
+	// the value is not committed and the replicas are removed on a mismatch.
+	shasum = sha256.Sum256([]byte("other"))
+	if code := put("/mismatch", "X-Jakaja-Checksum-SHA256", hex.EncodeToString(shasum[:])); code != http.StatusBadRequest {
+		t.Fatalf("put with mismatching sha256: got status %d", code)
+	}
+
+	if w := request(e, http.MethodGet, "/mismatch", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after mismatch: got status %d", w.Code)
+	}
+
+	for _, s := range e.Storages {
+		_, err := volume.Open(s).Head(context.Background(), entry.HashKey([]byte("/mismatch")))
+		if !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("mismatching value on %s was not removed: %v", s, err)
+		}
+	}
+
+	// volume servers commit the value once they have received the whole
+	// body, unlike the mem driver.
+	e.Storages = volumeServers(t, 3)
+	e.ReplicaCount = 3
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/mismatch%d", i)
+		if code := put(key, "X-Jakaja-Checksum-SHA256", hex.EncodeToString(shasum[:])); code != http.StatusBadRequest {
+			t.Fatalf("put with mismatching sha256 to volume servers: got status %d", code)
+		}
+
+		for _, s := range e.Storages {
+			_, err := volume.Open(s).Head(context.Background(), entry.HashKey([]byte(key)))
+			if !errors.Is(err, volume.ErrNotFound) {
+				t.Fatalf("mismatching value on %s was not removed: %v", s, err)
+			}
+		}
+	}
+}
+
+func Test_hashAlgo(t *testing.T) {
+	e := newEngine(t)
+	e.HashAlgo = entry.BLAKE3
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	sum := blake3.Sum256([]byte("value"))
+	w := request(e, http.MethodGet, "/key", "")
+	if got := w.Header().Get("X-Jakaja-Checksum-BLAKE3"); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected checksum: %s", got)
+	}
+
+	// entries written with another algorithm are still verified with their own
+	// algorithm.
+	e.HashAlgo = entry.MD5
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() || report.Keys != 1 {
+		t.Fatalf("unexpected verify report: %+v", report)
+	}
+}
+
+func Test_migrateIndex(t *testing.T) {
+	e := newEngine(t)
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+	ent := e.Get([]byte("/key"))
+
+	// rewrite the entry in the legacy format.
+	legacy := "HASH" + ent.Hash + strings.Join(ent.Storages, ",")
+	if err := e.DB.Put([]byte("/key"), []byte(legacy), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := e.MigrateIndex()
+	if err != nil || migrated != 1 {
+		t.Fatalf("migrate: migrated %d entries: %v", migrated, err)
+	}
+
+	b, err := e.DB.Get([]byte("/key"), nil)
+	if err != nil || entry.IsLegacy(b) {
+		t.Fatalf("entry was not migrated: %q", b)
+	}
+
+	w := request(e, http.MethodGet, "/key", "")
+	if w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get after migration: got status %d and body %q", w.Code, w.Body.String())
+	}
+}
+
+func Test_metadata(t *testing.T) {
+	e := newEngine(t)
+
+	r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("value"))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	// HEAD is answered from the index even if the storages are unavailable.
+	ent := e.Get([]byte("/key"))
+	for _, s := range ent.Storages {
+		if err := volume.Open(s).Delete(context.Background(), ent.Path([]byte("/key"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w = request(e, http.MethodHead, "/key", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5" ||
+		w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("head: got status %d and headers %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodHead, "/key", nil)
+	r.Header.Set("If-Modified-Since", w.Header().Get("Last-Modified"))
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("head with If-Modified-Since: got status %d", w.Code)
+	}
+
+	res := e.List("/", "", "", 10)
+	if len(res.Keys) != 1 || res.Keys[0].Size != 5 || res.Keys[0].ContentType != "text/plain" || res.Keys[0].Modified == nil {
+		t.Fatalf("unexpected listing: %+v", res.Keys)
+	}
+}
+
+func Test_userMetadata(t *testing.T) {
+	e := newEngine(t)
+
+	r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("value"))
+	r.Header.Set("X-Jakaja-Meta-Uploader", "1234")
+	r.Header.Set("X-Jakaja-Meta-Filename", "a.txt")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	w = request(e, http.MethodGet, "/key", "")
+	if w.Header().Get("X-Jakaja-Meta-Uploader") != "1234" || w.Header().Get("X-Jakaja-Meta-Filename") != "a.txt" {
+		t.Fatalf("get: unexpected headers %v", w.Header())
+	}
+	hash := e.Get([]byte("/key")).Hash
+
+	for _, method := range []string{http.MethodPatch, http.MethodPost} {
+		url := "/key"
+		if method == http.MethodPost {
+			url += "?metadata"
+		}
+
+		r = httptest.NewRequest(method, url, nil)
+		r.Header.Set("X-Jakaja-Meta-Filename", "")
+		r.Header.Set("X-Jakaja-Meta-Pipeline", method)
+		w = httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s metadata: got status %d", method, w.Code)
+		}
+
+		ent := e.Get([]byte("/key"))
+		if ent.Hash != hash || len(ent.Meta) != 2 || ent.Meta["uploader"] != "1234" || ent.Meta["pipeline"] != method {
+			t.Fatalf("%s metadata: unexpected entry %+v", method, ent)
+		}
+	}
+}
+
+func Test_expiry(t *testing.T) {
+	e := newEngine(t)
+
+	for _, h := range [][2]string{
+		{"X-Jakaja-TTL", "soon"},
+		{"X-Jakaja-TTL", "-5"},
+		{"X-Jakaja-Expires", "Mon, 02 Jan 2006 15:04:05 GMT"},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("value"))
+		r.Header.Set(h[0], h[1])
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("put with %s %q: got status %d", h[0], h[1], w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("value"))
+	r.Header.Set("X-Jakaja-TTL", "50ms")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPut, "/other", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	w = request(e, http.MethodHead, "/key", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Jakaja-Expires") == "" {
+		t.Fatalf("head before expiry: got status %d and headers %v", w.Code, w.Header())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after expiry: got status %d", w.Code)
+	}
+
+	if keys := e.List("/", "", "", 10).Keys; len(keys) != 1 || keys[0].Key != "/other" {
+		t.Fatalf("list after expiry: got %v", keys)
+	}
+
+	e.Reap()
+	if ent := e.Get([]byte("/key")); ent.Status != entry.HardDeleted {
+		t.Fatalf("reap: key still has status %d", ent.Status)
+	}
+
+	if ent := e.Get([]byte("/other")); ent.Status != entry.Exists {
+		t.Fatalf("reap: other key has status %d", ent.Status)
+	}
+
+	if n := e.Stats().Expired; n != 1 {
+		t.Fatalf("reap: expected 1 expired key, got %d", n)
+	}
+}
+
+func Test_lifecycle(t *testing.T) {
+	e := newEngine(t)
+
+	path := filepath.Join(t.TempDir(), "lifecycle.json")
+	config := fmt.Sprintf(`{
+		"groups": {"cold": ["mem://%[1]s-cold-0", "mem://%[1]s-cold-1"]},
+		"rules": [
+			{"prefix": "/tmp/", "expireAfter": "1ns"},
+			{"prefix": "logs/", "transitionAfter": "1ns", "group": "cold"},
+			{"prefix": "/", "expireAfter": "7d"}
+		]
+	}`, t.Name())
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lc, err := engine.LoadLifecycle(path)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	e.Groups = lc.Groups
+	e.Lifecycle = lc
+
+	var audit bytes.Buffer
+	e.AuditLog = &audit
+
+	for _, k := range []string{"/tmp/a", "/logs/a", "/other"} {
+		if w := request(e, http.MethodPut, k, "value"); w.Code != http.StatusCreated {
+			t.Fatalf("put %s: got status %d", k, w.Code)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	e.ApplyLifecycle()
+
+	if ent := e.Get([]byte("/tmp/a")); ent.Status != entry.HardDeleted {
+		t.Fatalf("expire: key still has status %d", ent.Status)
+	}
+
+	if ent := e.Get([]byte("/other")); ent.Status != entry.Exists || ent.Group != "" {
+		t.Fatalf("unexpected entry for a key without due rules: %+v", ent)
+	}
+
+	check := func(stage string) {
+		ent := e.Get([]byte("/logs/a"))
+		if ent.Group != "cold" || len(ent.Storages) != 2 || !strings.Contains(ent.Storages[0], "-cold-") {
+			t.Fatalf("%s: unexpected entry %+v", stage, ent)
+		}
+
+		w := request(e, http.MethodGet, "/logs/a", "")
+		if w.Code != http.StatusOK || w.Body.String() != "value" {
+			t.Fatalf("%s: got status %d and body %q", stage, w.Code, w.Body.String())
+		}
+	}
+	check("transition")
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"action":"transition"`) ||
+		!strings.Contains(lines[1], `"action":"expire"`) {
+		t.Fatalf("unexpected audit log: %s", audit.String())
+	}
+
+	if s := e.Stats(); s.Expired != 1 || s.Transitions != 1 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// the values on the cold storages are found by a rebuild.
+	e.Build()
+	check("build")
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"prefix": "/logs/", "transitionAfter": "1h", "group": "cold"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.LoadLifecycle(path); err == nil {
+		t.Fatal("load: expected an error for an unknown group")
+	}
+}
+
+func Test_trash(t *testing.T) {
+	e := newEngine(t)
+	e.TrashRetention = time.Hour
+	e.GCDelay = time.Nanosecond
+
+	if w := request(e, http.MethodPut, "/key", "value"); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: got status %d", w.Code)
+	}
+
+	if ent := e.Get([]byte("/key")); !ent.Trashed() {
+		t.Fatalf("delete: key is not in the trash: %+v", ent)
+	}
+
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete in trash: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPost, "/key?undelete", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("undelete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get after undelete: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// writing a key in the trash replaces the deleted value.
+	request(e, http.MethodDelete, "/key", "")
+	if w := request(e, http.MethodPut, "/key", "new value"); w.Code != http.StatusCreated {
+		t.Fatalf("put over trash: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != "new value" {
+		t.Fatalf("get after put over trash: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := request(e, http.MethodPost, "/key?undelete", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("undelete of a live key: got status %d", w.Code)
+	}
+
+	// the trash survives a rebuild once the old files are gone.
+	request(e, http.MethodDelete, "/key", "")
+	time.Sleep(time.Millisecond)
+	e.CollectGarbage()
+	e.Build()
+
+	if ent := e.Get([]byte("/key")); !ent.Trashed() || len(ent.Storages) != 2 {
+		t.Fatalf("build: unexpected entry %+v", ent)
+	}
+
+	e.TrashRetention = time.Nanosecond
+	e.Purge()
+
+	if ent := e.Get([]byte("/key")); ent.Status != entry.HardDeleted {
+		t.Fatalf("purge: key still has status %d", ent.Status)
+	}
+
+	if w := request(e, http.MethodPost, "/key?undelete", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("undelete after purge: got status %d", w.Code)
+	}
+}
+
+func Test_erasure(t *testing.T) {
+	e := newEngine(t)
+	e.DataShards = 3
+	e.ParityShards = 2
+	for i := len(e.Storages); i < 6; i++ {
+		e.Storages = append(e.Storages, fmt.Sprintf("mem://%s-%d", t.Name(), i))
+	}
+
+	// the value spans a few stripes and ends in the middle of one.
+	value := make([]byte, 500<<10)
+	for i := range value {
+		value[i] = byte(i * 7 / 3)
+	}
+	key := []byte("/key")
+
+	if w := request(e, http.MethodPut, "/key", string(value)); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	ent := e.Get(key)
+	if !ent.Sharded() || len(ent.Storages) != 5 || ent.Size != int64(len(value)) {
+		t.Fatalf("put: unexpected entry %+v", ent)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// the value is decoded from the rest of the shards.
+	for _, i := range []int{0, 4} {
+		if err := volume.Open(ent.Storages[i]).Delete(context.Background(), ent.FilePath(key, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+	r.Header.Set("Range", "bytes=200000-300000")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), value[200000:300001]) {
+		t.Fatalf("range with missing shards: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// the read noticed the missing data shard, so it's rebuilt in the
+	// background.
+	deadline := time.Now().Add(5 * time.Second)
+	for s := e.Stats(); (s.Repairs == 0 || s.Repairs < s.ReadRepairs) && time.Now().Before(deadline); s = e.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := volume.Open(ent.Storages[0]).Head(context.Background(), ent.FilePath(key, 0)); err != nil {
+		t.Fatalf("read repair: shard 0 is missing: %s", err)
+	}
+
+	// the verification rebuilds every missing shard.
+	for _, i := range []int{0, 4} {
+		if err := volume.Open(ent.Storages[i]).Delete(context.Background(), ent.FilePath(key, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if report := e.Verify(engine.VerifyOptions{Repair: true}); report.Missing != 2 || report.Repaired != 2 {
+		t.Fatalf("verify: unexpected report %+v", report)
+	}
+
+	for i, s := range ent.Storages {
+		if _, err := volume.Open(s).Head(context.Background(), ent.FilePath(key, i)); err != nil {
+			t.Fatalf("repair: shard %d is missing: %s", i, err)
+		}
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() {
+		t.Fatalf("verify: unexpected report %+v", report)
+	}
+
+	// the index is rebuilt from the headers of the shards.
+	e.Build()
+
+	built := e.Get(key)
+	if !built.Sharded() || built.Size != ent.Size || strings.Join(built.Storages, ",") != strings.Join(ent.Storages, ",") {
+		t.Fatalf("build: unexpected entry %+v", built)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get after build: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// the shards follow the storages where they belong.
+	e.Storages = append(e.Storages, fmt.Sprintf("mem://%s-%d", t.Name(), len(e.Storages)))
+	e.Balance()
+
+	balanced := e.Get(key)
+	keyStorages := entry.KeyToStorage(key, e.Storages, 5, 1)
+	if strings.Join(balanced.Storages, ",") != strings.Join(keyStorages, ",") {
+		t.Fatalf("balance: got storages %v, want %v", balanced.Storages, keyStorages)
+	}
+
+	// the moved shards are removed from the storages they were moved from.
+	moved := 0
+	for i, s := range ent.Storages {
+		if s == balanced.Storages[i] {
+			continue
+		}
+		moved++
+
+		if _, err := volume.Open(s).Head(context.Background(), ent.FilePath(key, i)); !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("balance: shard %d was not removed from %s: %v", i, s, err)
+		}
+	}
+
+	if moved == 0 {
+		t.Fatal("balance: no shard was moved")
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get after balance: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	for i, s := range balanced.Storages {
+		if _, err := volume.Open(s).Head(context.Background(), balanced.FilePath(key, i)); !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("delete: shard %d still exists", i)
+		}
+	}
+}
+
+func Test_chunks(t *testing.T) {
+	e := newEngine(t)
+	e.ChunkSize = 1000
+	e.TrashRetention = time.Hour
+	e.GCDelay = time.Nanosecond
+
+	value := make([]byte, 4500)
+	for i := range value {
+		value[i] = byte(i * 7 / 3)
+	}
+	key := []byte("/key")
+
+	if w := request(e, http.MethodPut, "/key", string(value)); w.Code != http.StatusCreated {
+		t.Fatalf("put: got status %d", w.Code)
+	}
+
+	ent := e.Get(key)
+	if len(ent.Chunks) != 5 || ent.Chunks[4].Size != 500 || ent.Size != int64(len(value)) {
+		t.Fatalf("put: unexpected entry %+v", ent)
+	}
+
+	for i, c := range ent.Chunks {
+		if len(c.Storages) != 2 {
+			t.Fatalf("put: chunk %d has storages %v", i, c.Storages)
+		}
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+	r.Header.Set("Range", "bytes=950-3100")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), value[950:3101]) {
+		t.Fatalf("range: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// values of unknown length are chunked while they're written.
+	r = httptest.NewRequest(http.MethodPut, "/stream", bytes.NewReader(value[:2500]))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put without length: got status %d", w.Code)
+	}
+
+	if ent := e.Get([]byte("/stream")); len(ent.Chunks) != 3 || ent.Size != 2500 {
+		t.Fatalf("put without length: unexpected entry %+v", ent)
+	}
+
+	// a missing copy of a chunk is repaired from the other one.
+	c := ent.Chunks[2]
+	if err := volume.Open(c.Storages[0]).Delete(context.Background(), entry.ChunkPath(ent.Path(key), 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{Repair: true}); report.Missing != 1 || report.Repaired != 1 {
+		t.Fatalf("verify: unexpected report %+v", report)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() {
+		t.Fatalf("verify after repair: unexpected report %+v", report)
+	}
+
+	// the chunks are moved with the value into the trash and back.
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPost, "/key?undelete", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("undelete: got status %d", w.Code)
+	}
+	time.Sleep(time.Millisecond)
+	e.CollectGarbage()
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get after undelete: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// the manifest is rebuilt from the chunk files.
+	e.Build()
+
+	ent = e.Get(key)
+	if len(ent.Chunks) != 5 || ent.Size != int64(len(value)) {
+		t.Fatalf("build: unexpected entry %+v", ent)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get after build: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// every chunk follows the storages where it belongs.
+	e.Storages = append(e.Storages, fmt.Sprintf("mem://%s-%d", t.Name(), len(e.Storages)))
+	e.Balance()
+
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() {
+		t.Fatalf("verify after balance: unexpected report %+v", report)
+	}
+
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("get after balance: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	e.TrashRetention = 0
+	ent = e.Get(key)
+	if w := request(e, http.MethodDelete, "/key", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	for i, c := range ent.Chunks {
+		for _, s := range c.Storages {
+			if _, err := volume.Open(s).Head(context.Background(), entry.ChunkPath(ent.Path(key), i)); !errors.Is(err, volume.ErrNotFound) {
+				t.Fatalf("delete: chunk %d still exists on %s", i, s)
+			}
+		}
+	}
+}
+
+func Test_multipart(t *testing.T) {
+	e := newEngine(t)
+
+	start := func(key string) string {
+		w := request(e, http.MethodPost, key+"?uploads", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("start: got status %d", w.Code)
+		}
+
+		var upload struct {
+			ID string `json:"uploadId"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &upload); err != nil || upload.ID == "" {
+			t.Fatalf("start: invalid response %q", w.Body.String())
+		}
+		return upload.ID
+	}
+
+	// partFiles returns the files of the uploaded parts.
+	partFiles := func(key, id string) []string {
+		w := request(e, http.MethodGet, key+"?uploadId="+id, "")
+		var upload struct {
+			Parts []struct {
+				Number int    `json:"partNumber"`
+				ID     string `json:"id"`
+			} `json:"parts"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &upload); err != nil {
+			t.Fatalf("list: invalid response %q", w.Body.String())
+		}
+
+		files := make([]string, 0, len(upload.Parts))
+		for _, p := range upload.Parts {
+			c := entry.Chunk{ID: p.ID}
+			files = append(files, c.Path((&entry.Entry{Version: id}).Path([]byte(key)), p.Number-1))
+		}
+		return files
+	}
+
+	removed := func(op string, files []string) {
+		for _, f := range files {
+			for _, s := range e.Storages {
+				if _, err := volume.Open(s).Head(context.Background(), f); !errors.Is(err, volume.ErrNotFound) {
+					t.Fatalf("%s: part %s still exists on %s", op, f, s)
+				}
+			}
+		}
+	}
+
+	id := start("/key")
+	parts := []string{"first part,", "second part,", "third part"}
+	part := func(n int, body string) *httptest.ResponseRecorder {
+		return request(e, http.MethodPut, fmt.Sprintf("/key?uploadId=%s&partNumber=%d", id, n), body)
+	}
+
+	// parts can be uploaded in any order and uploading a part again replaces
+	// it.
+	for _, n := range []int{3, 1, 2} {
+		if w := part(n, "x"); w.Code != http.StatusOK {
+			t.Fatalf("part %d: got status %d", n, w.Code)
+		}
+	}
+	replaced := partFiles("/key", id)
+
+	etags := make([]string, len(parts))
+	for i, p := range parts {
+		w := part(i+1, p)
+		if w.Code != http.StatusOK {
+			t.Fatalf("part %d: got status %d", i+1, w.Code)
+		}
+		etags[i] = w.Header().Get("Etag")
+
+		if etags[i] != fmt.Sprintf(`"%x"`, md5.Sum([]byte(p))) {
+			t.Fatalf("part %d: got etag %s", i+1, etags[i])
+		}
+	}
+
+	// the files of the replaced parts are removed.
+	removed("replace", replaced)
+
+	if w := part(0, "x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("part 0: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPut, "/key?uploadId=missing&partNumber=1", "x"); w.Code != http.StatusNotFound {
+		t.Fatalf("part of missing upload: got status %d", w.Code)
+	}
+
+	w := request(e, http.MethodGet, "/key?uploadId="+id, "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "partNumber") != 3 {
+		t.Fatalf("list: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// the value doesn't exist until the upload is completed.
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get before completing: got status %d", w.Code)
+	}
+
+	wrong := fmt.Sprintf(`{"parts":[{"partNumber":1,"etag":%q}]}`, etags[1])
+	if w := request(e, http.MethodPost, "/key?uploadId="+id, wrong); w.Code != http.StatusBadRequest {
+		t.Fatalf("complete with wrong etag: got status %d", w.Code)
+	}
+
+	// the etag of the value is computed from the etags of the parts.
+	sums := make([]byte, 0)
+	for _, p := range parts {
+		sum := md5.Sum([]byte(p))
+		sums = append(sums, sum[:]...)
+	}
+	tag := fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(parts))
+
+	w = request(e, http.MethodPost, "/key?uploadId="+id, "")
+	if w.Code != http.StatusCreated || w.Header().Get("Etag") != tag {
+		t.Fatalf("complete: got status %d and etag %s", w.Code, w.Header().Get("Etag"))
+	}
+
+	value := strings.Join(parts, "")
+	if w := request(e, http.MethodGet, "/key", ""); w.Code != http.StatusOK || w.Body.String() != value || w.Header().Get("Etag") != tag {
+		t.Fatalf("get: got status %d, etag %s and body %q", w.Code, w.Header().Get("Etag"), w.Body.String())
+	}
+
+	if w := request(e, http.MethodGet, "/key?uploadId="+id, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("list after completing: got status %d", w.Code)
+	}
+
+	// the checksum of the value is not known when the upload is completed, so
+	// the verification stores it instead of checking the value.
+	if ent := e.Get([]byte("/key")); ent.Hash != "" {
+		t.Fatalf("complete: got checksum %s", ent.Hash)
+	}
+
+	if report := e.Verify(engine.VerifyOptions{}); !report.OK() {
+		t.Fatalf("verify: unexpected report %+v", report)
+	}
+
+	if ent := e.Get([]byte("/key")); ent.Hash != fmt.Sprintf("%x", md5.Sum([]byte(value))) {
+		t.Fatalf("verify: got checksum %s", ent.Hash)
+	}
+
+	// the etag stays the same once the verification has filled in the
+	// checksum.
+	if w := request(e, http.MethodHead, "/key", ""); w.Header().Get("Etag") != tag {
+		t.Fatalf("head after verify: got etag %s", w.Header().Get("Etag"))
+	}
+
+	// existing keys are only replaced when asked to.
+	if w := request(e, http.MethodPost, "/key?uploads", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("start on existing key: got status %d", w.Code)
+	}
+
+	// aborting removes the parts.
+	id = start("/other")
+	if w := request(e, http.MethodPut, "/other?uploadId="+id+"&partNumber=1", "part"); w.Code != http.StatusOK {
+		t.Fatalf("other part: got status %d", w.Code)
+	}
+
+	files := partFiles("/other", id)
+	if w := request(e, http.MethodDelete, "/other?uploadId="+id, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("abort: got status %d", w.Code)
+	}
+	removed("abort", files)
+
+	if w := request(e, http.MethodPost, "/other?uploadId="+id, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("complete after abort: got status %d", w.Code)
+	}
+
+	// uploads that are never completed are aborted by the reaper.
+	id = start("/other")
+	if w := request(e, http.MethodPut, "/other?uploadId="+id+"&partNumber=1", "part"); w.Code != http.StatusOK {
+		t.Fatalf("stale part: got status %d", w.Code)
+	}
+	files = partFiles("/other", id)
+	e.UploadExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	e.ReapUploads()
+
+	if w := request(e, http.MethodGet, "/other?uploadId="+id, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("list after reaping: got status %d", w.Code)
+	}
+
+	removed("reap", files)
+}
+
+// s3Client signs requests to the S3 gateway the same way as the aws sdks.
+type s3Client struct {
+	g      *engine.S3Gateway
+	id     string
+	secret string
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// request creates a signed request. If chunkSize is positive, the body is
+// sent in the aws-chunked encoding in chunks of chunkSize.
+func (c *s3Client) request(method, target string, body []byte, header http.Header, chunkSize int) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	date := time.Now().UTC().Format("20060102T150405Z")
+	scope := date[:8] + "/us-east-1/s3/aws4_request"
+	key := []byte("AWS4" + c.secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSum(key, part)
+	}
+
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	if chunkSize > 0 {
+		payload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+		r.Header.Set("Content-Encoding", "aws-chunked")
+		r.Header.Set("X-Amz-Decoded-Content-Length", fmt.Sprint(len(body)))
+	}
+	r.Header.Set("X-Amz-Date", date)
+	r.Header.Set("X-Amz-Content-Sha256", payload)
+
+	query := make([]string, 0)
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			query = append(query, url.QueryEscape(name)+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	sort.Strings(query)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		method,
+		r.URL.EscapedPath(),
+		strings.Join(query, "&"),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + date + "\n",
+		signed,
+		payload,
+	}, "\n")
+
+	sum = sha256.Sum256([]byte(canonical))
+	signature := hex.EncodeToString(hmacSum(key, "AWS4-HMAC-SHA256\n"+date+"\n"+scope+"\n"+hex.EncodeToString(sum[:])))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.id, scope, signed, signature))
+
+	if chunkSize > 0 {
+		var encoded bytes.Buffer
+		for rest := body; ; {
+			chunk := rest
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			rest = rest[len(chunk):]
+
+			sum = sha256.Sum256(chunk)
+			signature = hex.EncodeToString(hmacSum(key, "AWS4-HMAC-SHA256-PAYLOAD\n"+date+"\n"+scope+"\n"+signature+
+				"\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n"+hex.EncodeToString(sum[:])))
+			fmt.Fprintf(&encoded, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), signature, chunk)
+
+			if len(chunk) == 0 {
+				break
+			}
+		}
+		body = encoded.Bytes()
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r
+}
+
+func (c *s3Client) do(method, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.g.ServeHTTP(w, c.request(method, target, body, header, 0))
+	return w
+}
+
+func Test_s3(t *testing.T) {
+	e := newEngine(t)
+	c := &s3Client{
+		g:      engine.NewS3Gateway(e, []engine.S3Credential{{AccessKeyID: "key", SecretAccessKey: "secret"}}),
+		id:     "key",
+		secret: "secret",
+	}
+
+	// requests need a valid signature.
+	w := httptest.NewRecorder()
+	c.g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unsigned: got status %d", w.Code)
+	}
+
+	wrong := &s3Client{g: c.g, id: "key", secret: "wrong"}
+	if w := wrong.do(http.MethodGet, "/", nil, nil); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "SignatureDoesNotMatch") {
+		t.Fatalf("wrong secret: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// buckets are key prefixes.
+	w = c.do(http.MethodPut, "/photos/a.txt", []byte("value"), http.Header{"X-Amz-Meta-Owner": {"me"}})
+	if w.Code != http.StatusOK || w.Header().Get("Etag") != fmt.Sprintf(`"%x"`, md5.Sum([]byte("value"))) {
+		t.Fatalf("put: got status %d and etag %s", w.Code, w.Header().Get("Etag"))
+	}
+
+	if ent := e.Get([]byte("/photos/a.txt")); ent.Status != entry.Exists || ent.Meta["owner"] != "me" {
+		t.Fatalf("put: unexpected entry %+v", ent)
+	}
+
+	w = c.do(http.MethodGet, "/photos/a.txt", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "value" || w.Header().Get("X-Amz-Meta-Owner") != "me" {
+		t.Fatalf("get: got status %d, body %q and headers %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	if w := c.do(http.MethodHead, "/photos/a.txt", nil, nil); w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5" {
+		t.Fatalf("head: got status %d and headers %v", w.Code, w.Header())
+	}
+
+	if w := c.do(http.MethodGet, "/photos/missing", nil, nil); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchKey") {
+		t.Fatalf("get missing: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// the body has to match the signed digest.
+	r := c.request(http.MethodPut, "/photos/b.txt", []byte("value"), nil, 0)
+	r.Body = io.NopCloser(strings.NewReader("other"))
+	w = httptest.NewRecorder()
+	c.g.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("put with wrong digest: got status %d", w.Code)
+	}
+
+	// bodies can be sent in signed chunks.
+	value := bytes.Repeat([]byte("0123456789"), 300)
+	w = httptest.NewRecorder()
+	c.g.ServeHTTP(w, c.request(http.MethodPut, "/photos/dir/chunked", value, nil, 1024))
+	if w.Code != http.StatusOK {
+		t.Fatalf("chunked put: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := c.do(http.MethodGet, "/photos/dir/chunked", nil, nil); !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("chunked get: got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	r = c.request(http.MethodPut, "/photos/tampered", value, nil, 1024)
+	tampered, _ := io.ReadAll(r.Body)
+	tampered[len(tampered)/2]++
+	r.Body = io.NopCloser(bytes.NewReader(tampered))
+	w = httptest.NewRecorder()
+	c.g.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || e.Get([]byte("/photos/tampered")).Status == entry.Exists {
+		t.Fatalf("tampered chunked put: got status %d", w.Code)
+	}
+
+	w = c.do(http.MethodGet, "/photos?list-type=2&delimiter=/", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<Key>a.txt</Key>") ||
+		!strings.Contains(w.Body.String(), "<Prefix>dir/</Prefix>") || !strings.Contains(w.Body.String(), "<KeyCount>2</KeyCount>") {
+		t.Fatalf("list: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// listing continues from the continuation token.
+	w = c.do(http.MethodGet, "/photos?list-type=2&max-keys=1", nil, nil)
+	var list struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct{ Key string }
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil || !list.IsTruncated || len(list.Contents) != 1 {
+		t.Fatalf("paged list: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	w = c.do(http.MethodGet, "/photos?list-type=2&max-keys=1&continuation-token="+list.NextContinuationToken, nil, nil)
+	if !strings.Contains(w.Body.String(), "<Key>dir/chunked</Key>") || strings.Contains(w.Body.String(), "<IsTruncated>true") {
+		t.Fatalf("second page: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := c.do(http.MethodGet, "/", nil, nil); !strings.Contains(w.Body.String(), "<Name>photos</Name>") {
+		t.Fatalf("list buckets: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// multipart uploads are completed from the parts listed by the client.
+	w = c.do(http.MethodPost, "/photos/big?uploads", nil, nil)
+	var upload struct{ UploadId string }
+	if err := xml.Unmarshal(w.Body.Bytes(), &upload); err != nil || upload.UploadId == "" {
+		t.Fatalf("create upload: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	parts := []string{"first,", "second"}
+	complete := "<CompleteMultipartUpload>"
+	for i, p := range parts {
+		w := c.do(http.MethodPut, fmt.Sprintf("/photos/big?partNumber=%d&uploadId=%s", i+1, upload.UploadId), []byte(p), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload part %d: got status %d", i+1, w.Code)
+		}
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, w.Header().Get("Etag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+
+	if w := c.do(http.MethodGet, "/photos/big?uploadId="+upload.UploadId, nil, nil); strings.Count(w.Body.String(), "<Part>") != 2 {
+		t.Fatalf("list parts: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// xml bodies have to match the signed digest as well, although they're
+	// decoded without reading them to the end.
+	r = c.request(http.MethodPost, "/photos/big?uploadId="+upload.UploadId, []byte(complete), nil, 0)
+	r.Body = io.NopCloser(strings.NewReader(strings.Replace(complete, "<PartNumber>2</PartNumber>", "<PartNumber>3</PartNumber>", 1)))
+	w = httptest.NewRecorder()
+	c.g.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "XAmzContentSHA256Mismatch") {
+		t.Fatalf("tampered complete upload: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	sums := make([]byte, 0)
+	for _, p := range parts {
+		sum := md5.Sum([]byte(p))
+		sums = append(sums, sum[:]...)
+	}
+	tag := fmt.Sprintf(`"%x-2"`, md5.Sum(sums))
+
+	w = c.do(http.MethodPost, "/photos/big?uploadId="+upload.UploadId, []byte(complete), nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), html.EscapeString(tag)) {
+		t.Fatalf("complete upload: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// reading the object returns the same etag as completing it.
+	if w := c.do(http.MethodGet, "/photos/big", nil, nil); w.Body.String() != strings.Join(parts, "") || w.Header().Get("Etag") != tag {
+		t.Fatalf("get upload: got status %d, etag %s and body %q", w.Code, w.Header().Get("Etag"), w.Body.String())
+	}
+
+	if w := c.do(http.MethodDelete, "/photos", nil, nil); w.Code != http.StatusConflict {
+		t.Fatalf("delete non-empty bucket: got status %d", w.Code)
+	}
+
+	// deleting a missing object succeeds.
+	for i := 0; i < 2; i++ {
+		if w := c.do(http.MethodDelete, "/photos/a.txt", nil, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("delete %d: got status %d", i, w.Code)
+		}
+	}
+
+	r = c.request(http.MethodPost, "/photos?delete", []byte("<Delete><Object><Key>a.txt</Key></Object></Delete>"), nil, 0)
+	r.Body = io.NopCloser(strings.NewReader("<Delete><Object><Key>big</Key></Object></Delete>"))
+	w = httptest.NewRecorder()
+	c.g.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || e.Get([]byte("/photos/big")).Status != entry.Exists {
+		t.Fatalf("tampered delete objects: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	body := []byte("<Delete><Object><Key>dir/chunked</Key></Object><Object><Key>big</Key></Object></Delete>")
+	w = c.do(http.MethodPost, "/photos?delete", body, nil)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "<Deleted>") != 2 {
+		t.Fatalf("delete objects: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	if w := c.do(http.MethodDelete, "/photos", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete bucket: got status %d and body %q", w.Code, w.Body.String())
+	}
+}
+
+func Test_dedup(t *testing.T) {
+	e := newEngine(t)
+	e.HashAlgo = entry.SHA256
+	e.Dedup = true
+	e.TrashRetention = time.Hour
+
+	for _, key := range []string{"/a", "/b"} {
+		if w := request(e, http.MethodPut, key, "value"); w.Code != http.StatusCreated {
+			t.Fatalf("put %s: got status %d", key, w.Code)
+		}
+	}
+
+	a, b := e.Get([]byte("/a")), e.Get([]byte("/b"))
+	path := a.Path([]byte("/a"))
+	if !a.Dedup || path != b.Path([]byte("/b")) || len(a.Storages) != 2 {
+		t.Fatalf("put: values don't share a blob: %+v %+v", a, b)
+	}
+
+	// only the blob is left on the storages.
+	for _, s := range e.Storages {
+		if _, err := volume.Open(s).Head(context.Background(), entry.HashKey([]byte("/a"))); !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("put: value left in the path of the key on %s: %v", s, err)
+		}
+	}
+
+	// the value in the trash keeps its reference until it's purged.
+	if w := request(e, http.MethodDelete, "/a", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodPost, "/a?undelete", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("undelete: got status %d", w.Code)
+	}
+
+	if w := request(e, http.MethodGet, "/a", ""); w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get after undelete: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	request(e, http.MethodDelete, "/a", "")
+	e.TrashRetention = time.Nanosecond
+	e.Purge()
+
+	if w := request(e, http.MethodGet, "/b", ""); w.Code != http.StatusOK || w.Body.String() != "value" {
+		t.Fatalf("get after purging a reference: got status %d and body %q", w.Code, w.Body.String())
+	}
+
+	// deleting the last reference removes the blob.
+	e.TrashRetention = 0
+	if w := request(e, http.MethodDelete, "/b", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete of the last reference: got status %d", w.Code)
+	}
+
+	for _, s := range e.Storages {
+		if _, err := volume.Open(s).Head(context.Background(), path); !errors.Is(err, volume.ErrNotFound) {
+			t.Fatalf("delete: blob left on %s: %v", s, err)
+		}
+	}
+}
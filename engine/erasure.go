@@ -0,0 +1,526 @@
+package engine
+
+// erasure.go implements erasure coding as an alternative to replication. The
+// value is split into stripes of DataShards blocks and for every stripe
+// ParityShards parity blocks are computed with Reed-Solomon coding. The i'th
+// block of every stripe is appended into the i'th shard and every shard is
+// stored on its own storage, chosen the same way as the storages of replicas.
+// The value can be decoded from any DataShards of the shards, so it survives
+// losing ParityShards storages while taking far less space than replicas.
+// Erasure coded values are always read through the master, which decodes
+// them.
+//
+// Every shard file begins with a header describing the shard, so that the
+// index can be rebuilt from the storages.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+)
+
+const (
+	// shardBlockSize is the size of the blocks of new shards. A write buffers
+	// a single stripe of blocks.
+	shardBlockSize = 64 << 10
+
+	shardHeaderSize = 20
+)
+
+var (
+	shardMagic = []byte("JKEC")
+
+	errShardHeader = errors.New("invalid shard header")
+	errTooFewShard = errors.New("not enough shards left to decode the value")
+)
+
+// ParseErasure parses an erasure coding scheme such as 6+3 into the amounts
+// of data and parity shards.
+func ParseErasure(scheme string) (int, int, error) {
+	d, p, ok := strings.Cut(scheme, "+")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid erasure coding scheme %q", scheme)
+	}
+
+	data, err := strconv.Atoi(d)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid erasure coding scheme %q", scheme)
+	}
+
+	parity, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid erasure coding scheme %q", scheme)
+	}
+
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return 0, 0, fmt.Errorf("erasure coding needs at least one data and parity shard and at most 256 shards")
+	}
+	return data, parity, nil
+}
+
+// shardHeader begins every shard file.
+type shardHeader struct {
+	Index        int
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Size         int64
+}
+
+func newShardHeader(ent entry.Entry, index int) shardHeader {
+	return shardHeader{
+		Index:        index,
+		DataShards:   ent.DataShards,
+		ParityShards: ent.ParityShards,
+		BlockSize:    ent.BlockSize,
+		Size:         ent.Size,
+	}
+}
+
+func (h *shardHeader) marshal() []byte {
+	b := make([]byte, 0, shardHeaderSize)
+	b = append(b, shardMagic...)
+	b = append(b, 1, byte(h.Index), byte(h.DataShards-1), byte(h.ParityShards))
+	b = binary.BigEndian.AppendUint32(b, uint32(h.BlockSize))
+	return binary.BigEndian.AppendUint64(b, uint64(h.Size))
+}
+
+func parseShardHeader(b []byte) (shardHeader, error) {
+	if len(b) < shardHeaderSize || !bytes.Equal(b[:4], shardMagic) || b[4] != 1 {
+		return shardHeader{}, errShardHeader
+	}
+
+	h := shardHeader{
+		Index:        int(b[5]),
+		DataShards:   int(b[6]) + 1,
+		ParityShards: int(b[7]),
+		BlockSize:    int(binary.BigEndian.Uint32(b[8:])),
+		Size:         int64(binary.BigEndian.Uint64(b[12:])),
+	}
+
+	if h.Index >= h.DataShards+h.ParityShards || h.BlockSize <= 0 {
+		return shardHeader{}, errShardHeader
+	}
+	return h, nil
+}
+
+// apply sets the erasure coding of the entry from the header.
+func (h *shardHeader) apply(ent *entry.Entry) {
+	ent.DataShards = h.DataShards
+	ent.ParityShards = h.ParityShards
+	ent.BlockSize = h.BlockSize
+	ent.Size = h.Size
+}
+
+// stripes returns the amount of stripes in an erasure coded value.
+func stripes(ent entry.Entry) int64 {
+	stripe := int64(ent.DataShards * ent.BlockSize)
+	return (ent.Size + stripe - 1) / stripe
+}
+
+// shardSize returns the size of the shard files of an erasure coded value.
+func shardSize(ent entry.Entry) int64 {
+	return shardHeaderSize + stripes(ent)*int64(ent.BlockSize)
+}
+
+// readShardHeader reads the header of the shard file at path.
+func (e *Engine) readShardHeader(storage, path string) (shardHeader, error) {
+	rc, err := e.volume(storage).Get(context.Background(), path, 0, shardHeaderSize)
+	if err != nil {
+		return shardHeader{}, err
+	}
+	defer rc.Close()
+
+	b := make([]byte, shardHeaderSize)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return shardHeader{}, errShardHeader
+	}
+	return parseShardHeader(b)
+}
+
+// stripeWriter splits the body into stripes and writes the data and parity
+// blocks of each stripe into the shard writes.
+type stripeWriter struct {
+	ws     *writeSet
+	enc    reedsolomon.Encoder
+	shards [][]byte
+
+	// buf contains the data blocks of the current stripe.
+	buf []byte
+	n   int
+}
+
+func newStripeWriter(ws *writeSet, enc reedsolomon.Encoder, ent entry.Entry) *stripeWriter {
+	sw := &stripeWriter{
+		ws:     ws,
+		enc:    enc,
+		shards: make([][]byte, ent.DataShards+ent.ParityShards),
+		buf:    make([]byte, ent.DataShards*ent.BlockSize),
+	}
+
+	for i := range sw.shards {
+		if i < ent.DataShards {
+			sw.shards[i] = sw.buf[i*ent.BlockSize : (i+1)*ent.BlockSize]
+		} else {
+			sw.shards[i] = make([]byte, ent.BlockSize)
+		}
+	}
+	return sw
+}
+
+func (sw *stripeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(sw.buf[sw.n:], p)
+		sw.n += n
+		written += n
+		p = p[n:]
+
+		if sw.n == len(sw.buf) {
+			if err := sw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the current stripe. The last stripe is padded with zeros.
+func (sw *stripeWriter) flush() error {
+	if sw.n == 0 {
+		return nil
+	}
+
+	for i := sw.n; i < len(sw.buf); i++ {
+		sw.buf[i] = 0
+	}
+	sw.n = 0
+
+	if err := sw.enc.Encode(sw.shards); err != nil {
+		return err
+	}
+
+	for i, rw := range sw.ws.writes {
+		sw.ws.write(rw, sw.shards[i])
+	}
+
+	if sw.ws.live < sw.ws.quorum {
+		return errQuorum
+	}
+	return nil
+}
+
+// writeShards erasure codes body into the shards of ent. The size of the body
+// has to be known beforehand. The write succeeds once the value can lose one
+// more shard, and it returns the storages that acknowledged their shard. The
+// missing shards are rebuilt by the repair worker.
+func (e *Engine) writeShards(key []byte, ent entry.Entry, body io.Reader, size int64) ([]string, error) {
+	if size < 0 {
+		return nil, errors.New("erasure coded writes need the size of the value")
+	}
+	ent.Size = size
+
+	enc, err := reedsolomon.New(ent.DataShards, ent.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(ent.Storages))
+	for i := range paths {
+		paths[i] = ent.FilePath(key, i)
+	}
+	ws := e.startWrites(ent.Storages, paths, shardSize(ent), ent.DataShards+1)
+
+	for i, rw := range ws.writes {
+		h := newShardHeader(ent, i)
+		ws.write(rw, h.marshal())
+	}
+
+	sw := newStripeWriter(ws, enc, ent)
+	n, err := io.Copy(sw, body)
+	if err == nil && n != size {
+		err = fmt.Errorf("body length %d does not match content length %d", n, size)
+	}
+
+	if err == nil {
+		err = sw.flush()
+	}
+
+	if err := e.finishWrites(ws, err); err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0, len(ent.Storages))
+	for _, rw := range ws.writes {
+		if rw.ok {
+			written = append(written, rw.storage)
+		}
+	}
+	return written, nil
+}
+
+// shardReader reads an erasure coded value. The shards are read as streams
+// from the current stripe onwards, preferring the data shards. If a shard
+// fails, the rest of the value is decoded with the next shard.
+type shardReader struct {
+	ctx     context.Context
+	e       *Engine
+	key     []byte
+	ent     entry.Entry
+	enc     reedsolomon.Encoder
+	limiter *rateLimiter
+
+	streams []io.ReadCloser
+	failed  []bool
+	blocks  [][]byte
+	missing []string
+
+	// next is the stripe the streams are at and stripe is the stripe in data.
+	next   int64
+	stripe int64
+	data   []byte
+	offset int64
+}
+
+// openShards opens a reader for an erasure coded value.
+func (e *Engine) openShards(ctx context.Context, key []byte, ent entry.Entry) (*shardReader, error) {
+	enc, err := reedsolomon.New(ent.DataShards, ent.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	n := ent.DataShards + ent.ParityShards
+	if len(ent.Storages) != n {
+		return nil, errTooFewShard
+	}
+
+	sr := &shardReader{
+		ctx:     ctx,
+		e:       e,
+		key:     key,
+		ent:     ent,
+		enc:     enc,
+		streams: make([]io.ReadCloser, n),
+		failed:  make([]bool, n),
+		blocks:  make([][]byte, n),
+		stripe:  -1,
+		data:    make([]byte, 0, ent.DataShards*ent.BlockSize),
+	}
+
+	for i := range sr.blocks {
+		sr.blocks[i] = make([]byte, ent.BlockSize)
+
+		// shards lost before the index was rebuilt have no storage.
+		if ent.Storages[i] == "" {
+			sr.failed[i] = true
+		}
+	}
+	return sr, nil
+}
+
+func (sr *shardReader) closeStreams() {
+	for i, rc := range sr.streams {
+		if rc != nil {
+			rc.Close()
+			sr.streams[i] = nil
+		}
+	}
+}
+
+// readStripe reads the blocks of a stripe from the first DataShards shards
+// that can be read. The blocks that were not read are empty.
+func (sr *shardReader) readStripe(s int64) ([][]byte, error) {
+	if s != sr.next {
+		sr.closeStreams()
+		sr.next = s
+	}
+
+	shards := make([][]byte, len(sr.blocks))
+	have := 0
+	for i := range shards {
+		shards[i] = sr.blocks[i][:0]
+		if have == sr.ent.DataShards || sr.failed[i] {
+			continue
+		}
+
+		storage := sr.ent.Storages[i]
+		if sr.streams[i] == nil {
+			offset := shardHeaderSize + s*int64(sr.ent.BlockSize)
+			rc, err := sr.e.volume(storage).Get(sr.ctx, sr.ent.FilePath(sr.key, i), offset, -1)
+			if err != nil {
+				if errors.Is(err, volume.ErrNotFound) {
+					sr.missing = append(sr.missing, storage)
+				}
+				log.Printf("shards: cannot read shard %d of %s from %s: %s\n", i, sr.key, storage, err)
+				sr.failed[i] = true
+				continue
+			}
+			sr.streams[i] = rc
+		}
+
+		var r io.Reader = sr.streams[i]
+		if sr.limiter != nil {
+			r = &limitedReader{r, sr.limiter}
+		}
+
+		if _, err := io.ReadFull(r, sr.blocks[i]); err != nil {
+			log.Printf("shards: shard %d of %s on %s failed: %s\n", i, sr.key, storage, err)
+			sr.streams[i].Close()
+			sr.streams[i] = nil
+			sr.failed[i] = true
+			continue
+		}
+		shards[i] = sr.blocks[i]
+		have++
+	}
+
+	if have < sr.ent.DataShards {
+		return nil, errTooFewShard
+	}
+
+	sr.next = s + 1
+	return shards, nil
+}
+
+// load decodes the data of a stripe.
+func (sr *shardReader) load(s int64) error {
+	shards, err := sr.readStripe(s)
+	if err != nil {
+		return err
+	}
+
+	if err := sr.enc.ReconstructData(shards); err != nil {
+		return err
+	}
+
+	sr.data = sr.data[:0]
+	for _, block := range shards[:sr.ent.DataShards] {
+		sr.data = append(sr.data, block...)
+	}
+
+	// the last stripe is padded.
+	if rest := sr.ent.Size - s*int64(len(sr.data)); rest < int64(len(sr.data)) {
+		sr.data = sr.data[:rest]
+	}
+	sr.stripe = s
+	return nil
+}
+
+func (sr *shardReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.ent.Size {
+		return 0, io.EOF
+	}
+
+	stripe := int64(sr.ent.DataShards * sr.ent.BlockSize)
+	s := sr.offset / stripe
+	if s != sr.stripe {
+		if err := sr.load(s); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.data[sr.offset-s*stripe:])
+	sr.offset += int64(n)
+	return n, nil
+}
+
+func (sr *shardReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.ent.Size
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative offset")
+	}
+	sr.offset = offset
+	return offset, nil
+}
+
+func (sr *shardReader) Close() error {
+	sr.closeStreams()
+	return nil
+}
+
+// proxyShards decodes an erasure coded value for the client. It returns the
+// storages that were missing their shard.
+func (e *Engine) proxyShards(w http.ResponseWriter, r *http.Request, key []byte, ent entry.Entry, etag string) []string {
+	sr, err := e.openShards(r.Context(), key, ent)
+	if err != nil {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	defer sr.Close()
+
+	// the first stripe is decoded before responding, so that a value that
+	// has lost too many shards is not served partially.
+	if ent.Size > 0 {
+		if err := sr.load(0); err != nil {
+			log.Printf("shards: cannot decode %s: %s\n", key, err)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return sr.missing
+		}
+	}
+
+	serveValue(w, r, sr, etag)
+	return sr.missing
+}
+
+// rebuildShard decodes the i'th shard of an erasure coded value from the other
+// shards and writes it into storage.
+func (e *Engine) rebuildShard(key []byte, ent entry.Entry, i int, storage string) error {
+	sr, err := e.openShards(context.Background(), key, ent)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	sr.failed[i] = true
+
+	pr, pw := io.Pipe()
+	go func() {
+		h := newShardHeader(ent, i)
+		if _, err := pw.Write(h.marshal()); err != nil {
+			return
+		}
+
+		for s := int64(0); s < stripes(ent); s++ {
+			shards, err := sr.readStripe(s)
+			if err == nil {
+				err = sr.enc.Reconstruct(shards)
+			}
+
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			if _, err := pw.Write(shards[i]); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	err = e.volume(storage).Put(ctx, ent.FilePath(key, i), pr, shardSize(ent))
+	pr.CloseWithError(err)
+	return err
+}
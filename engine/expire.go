@@ -0,0 +1,149 @@
+package engine
+
+// expire.go implements expiring values. Writes can set an expiry time with
+// X-Jakaja-Expires or a time to live with X-Jakaja-TTL. Expired values are not
+// readable and a background reaper deletes them. The reaper finds the expired
+// keys from a secondary index ordered by the expiry time, so it only reads the
+// part of the index that has expired.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	expiresHeader = "X-Jakaja-Expires"
+	ttlHeader     = "X-Jakaja-TTL"
+)
+
+// expirePrefix is the key namespace of the expiry index. The keys consist of
+// the expiry time and the object key. Overwriting or deleting a key leaves its
+// old expiry behind, so the reaper checks the entry before deleting anything.
+var expirePrefix = []byte("expire:")
+
+func expireKey(key []byte, expires time.Time) []byte {
+	k := make([]byte, 0, len(expirePrefix)+17+len(key))
+	k = append(k, expirePrefix...)
+	k = append(k, fmt.Sprintf("%016x", expires.UnixNano())...)
+	k = append(k, 0)
+	return append(k, key...)
+}
+
+// parseExpiry parses the expiry time of a write. X-Jakaja-Expires is either a
+// http date or a RFC 3339 time and X-Jakaja-TTL is either seconds or a
+// duration such as 24h. The time is zero if neither is given.
+func parseExpiry(r *http.Request) (time.Time, bool) {
+	expires, ttl := r.Header.Get(expiresHeader), r.Header.Get(ttlHeader)
+	if expires != "" && ttl != "" {
+		return time.Time{}, false
+	}
+
+	var t time.Time
+	switch {
+	case expires != "":
+		var err error
+		if t, err = http.ParseTime(expires); err != nil {
+			if t, err = time.Parse(time.RFC3339, expires); err != nil {
+				return time.Time{}, false
+			}
+		}
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			secs, serr := strconv.ParseInt(ttl, 10, 64)
+			if serr != nil {
+				return time.Time{}, false
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		t = time.Now().Add(d)
+	default:
+		return time.Time{}, true
+	}
+
+	// values that would expire right away are most likely mistakes.
+	if !t.After(time.Now()) {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// reap deletes key if it has expired at the time of the expiry index row.
+func (e *Engine) reap(key []byte, expires time.Time) bool {
+	if err := e.LockKey(string(key)); err != nil {
+		// try again on the next round.
+		return false
+	}
+	defer e.RemoveLock(string(key))
+
+	ent := e.Get(key)
+	if ent.Status != entry.Exists || !ent.Expires.Equal(expires) {
+		return true
+	}
+
+	if err := e.expire(key); err != nil {
+		log.Printf("reaper: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// expire deletes an expired key. With versioning, the key is hidden behind a
+// delete marker instead. The key must be locked.
+func (e *Engine) expire(key []byte) error {
+	if e.Versioning {
+		if _, err := e.hide(key); err != nil {
+			return fmt.Errorf("failed hiding %s: %w", key, err)
+		}
+	} else if status := e.DeleteHandler(key); status != http.StatusNoContent {
+		return fmt.Errorf("failed deleting %s: status %d", key, status)
+	}
+
+	e.counters.expired.Add(1)
+	return nil
+}
+
+// Reap deletes every key that has expired.
+func (e *Engine) Reap() {
+	now := time.Now()
+	limit := expireKey(nil, now)
+
+	it := e.DB.NewIterator(&util.Range{Start: expirePrefix, Limit: limit}, nil)
+	defer it.Release()
+
+	for it.Next() {
+		k := it.Key()[len(expirePrefix):]
+		sep := bytes.IndexByte(k, 0)
+		if sep < 0 {
+			continue
+		}
+
+		n, err := strconv.ParseUint(string(k[:sep]), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		key := make([]byte, len(k)-sep-1)
+		copy(key, k[sep+1:])
+		if e.reap(key, time.Unix(0, int64(n))) {
+			e.DB.Delete(it.Key(), nil)
+		}
+	}
+}
+
+// ReapWorker deletes the expired values every interval. Expired values are
+// hidden from reads as soon as they expire, so the interval only decides how
+// long they take up space.
+func (e *Engine) ReapWorker(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.Reap()
+	}
+}
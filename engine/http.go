@@ -5,23 +5,30 @@ package engine
 // - POST: Create entry
 // - GET: Find entry
 // - DELETE: Delete Entry
+// - GET /?list: List keys, see list.go
+// - GET /?stats: Engine counters, see stats.go
+// - Versions of a key, see version.go
+// - Conditional requests, see conditional.go
+// - PATCH: Update metadata, see metadata.go
+// - Expiring values, see expire.go
+// - POST /$KEY?undelete: Restore a deleted value, see trash.go
+// - Multipart uploads, see upload.go
 //
 // Address format is http://localhost:$PORT/$KEYNAME. Having KEYNAME as path makes
 // parsing easier and helps getting information out of the address. Other information
 // is not passed in the URL, rather using HTTP headers.
 
 import (
-	"bytes"
-	"crypto/md5"
-	"fmt"
+	"errors"
 	"io"
-	"math/rand"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
 )
 
 // shouldBalance checks that entryStorages and keyStorages should be the same.
@@ -40,61 +47,181 @@ func shouldBalance(entryStorages, keyStorages []string) bool {
 	return false
 }
 
+// PutOptions contains the per request options of a write.
+type PutOptions struct {
+	// WriteQuorum is the amount of storages that need to acknowledge the write.
+	// If zero, the engine's write quorum is used.
+	WriteQuorum int
+
+	// ContentMD5 and SHA256 are the expected digests of the value. The write
+	// fails if the received value doesn't match them.
+	ContentMD5 []byte
+	SHA256     []byte
+
+	// ContentType and Meta are stored in the index and returned when reading
+	// the value.
+	ContentType string
+	Meta        map[string]string
+
+	// Expires is when the value expires. Zero means never.
+	Expires time.Time
+}
+
+// canReplace reports whether a write may replace the current value of a key.
+// Existing keys can be overwritten when asked to, and with versioning the
+// write creates a new version instead. Expired keys can always be overwritten.
+func (e *Engine) canReplace(r *http.Request, ent entry.Entry) bool {
+	overwrite := r.Header.Get("If-Match") != "" || r.Header.Get(overwriteHeader) == "true"
+	return ent.Status != entry.Exists || overwrite || e.Versioning || ent.Expired(time.Now())
+}
+
 // WriteToStorage handles writing the key-value pair into storage volumes. It
 // returns the resulting http status code.
-func (e *Engine) WriteToStorage(key []byte, value io.Reader, clen int64) int {
-	keyStorages := entry.KeyToStorage(key, e.Storages, e.ReplicaCount, e.SubstorageCount)
-
-	// write entry into the leveldb
-	if err := e.Put(key, entry.Entry{
-		Storages: keyStorages,
-		Status:   entry.SoftDeleted,
-		Hash:     "",
-	}); err != nil {
-		return http.StatusInternalServerError
+func (e *Engine) WriteToStorage(key []byte, value io.Reader, clen int64, opts PutOptions) int {
+	ent := entry.Entry{Status: entry.SoftDeleted}
+	if e.DataShards > 0 {
+		ent.DataShards = e.DataShards
+		ent.ParityShards = e.ParityShards
+		ent.BlockSize = shardBlockSize
+	}
+	keyStorages := e.keyStorages(key, ent)
+	ent.Storages = keyStorages
+
+	quorum := opts.WriteQuorum
+	if quorum <= 0 {
+		quorum = e.writeQuorum()
+	}
+
+	// existing values stay readable until the write has finished, so the new
+	// value is written into a new path.
+	current := e.Get(key)
+	if e.Versioning || current.Status == entry.Exists || current.Trashed() {
+		ent.Version = e.pathID(key)
+	}
+
+	// write entry into the leveldb. A value in the trash keeps the key
+	// unreadable while writing, and it's replaced once the write has finished.
+	placeholder := current.Status != entry.Exists && !current.Trashed()
+	if placeholder {
+		if err := e.Put(key, ent); err != nil {
+			return http.StatusInternalServerError
+		}
+	}
+
+	// compute the checksums while the body is being streamed to the storages.
+	body := newChecksumReader(value, e.HashAlgo, opts)
+	chunked := e.shouldChunk(ent, clen)
+	var written, missing []string
+	var err error
+	switch {
+	case ent.Sharded():
+		written, err = e.writeShards(key, ent, body, clen)
+	case chunked:
+		ent.Chunks, missing, err = e.writeChunks(key, ent, body, clen, quorum)
+	default:
+		written, err = e.writeReplicas(keyStorages, ent.Path(key), body, clen, quorum)
+	}
+
+	// the checksum is known once the value has been written, so the value is
+	// moved into its blob afterwards. The blob has storages of its own.
+	if err == nil && e.shouldDedup(ent, chunked) {
+		ent.Hash, ent.HashAlgo, ent.Size = body.hash(), e.HashAlgo, body.size
+		ent, err = e.dedup(key, ent, written)
+		written, keyStorages = ent.Storages, e.keyStorages(key, ent)
 	}
 
-	buf, err := io.ReadAll(value)
 	if err != nil {
+		log.Printf("error writing to storages: %s\n", err)
+
+		// the value has been removed from the storages, so the key can be
+		// removed as well.
+		if placeholder {
+			e.DB.Delete(key, nil)
+		}
+
+		if errors.Is(err, errChecksum) {
+			return http.StatusBadRequest
+		}
 		return http.StatusInternalServerError
 	}
 
-	var wg sync.WaitGroup
+	// the entry only contains the storages that actually hold the value. The
+	// missing storages are filled in by the repair worker.
+	if !chunked {
+		missing = missingStorages(written, keyStorages)
+	}
 
-	// create a channel for errors so that we can concurrently handle them.
-	errs := make(chan error, len(keyStorages))
-	hashedKey := entry.HashKey(key)
+	if len(missing) > 0 {
+		log.Printf("key %s is under replicated, missing from %s\n", key, strings.Join(missing, ","))
+		e.queueRepair(key, missing)
+	}
 
-	// Start a thread for each key storage that transports the file.
-	for i := 0; i < len(keyStorages); i++ {
-		wg.Add(1)
+	// the shards are in the order of the storages, so the storages missing
+	// their shard are kept in the entry. The chunks have their own storages.
+	switch {
+	case chunked:
+		ent.Storages = []string{}
+	case !ent.Sharded():
+		ent.Storages = written
+	}
+	ent.Status = entry.Exists
+	ent.Hash = body.hash()
+	ent.HashAlgo = e.HashAlgo
+	ent.Size = body.size
+	ent.ContentType = opts.ContentType
+	ent.Meta = opts.Meta
+	ent.Expires = opts.Expires
+	ent.Modified = time.Now().UTC()
+
+	// the reference taken on the blob is released if the value doesn't make
+	// it into the index, so that the blob isn't kept forever.
+	status := e.commitEntry(key, current, ent)
+	if status != http.StatusCreated && ent.Dedup {
+		if err := e.releaseBlob(ent.Path(key)); err != nil {
+			log.Printf("dedup: failed releasing %s: %s\n", key, err)
+		}
+	}
+	return status
+}
 
-		// start a thread that writes a given io.Reader body to a storage server using a HTTP Put request.
-		go func(storage string, body io.Reader) {
-			defer wg.Done()
-			addr := fmt.Sprintf("http://%s%s", storage, hashedKey)
-			if err := httpput(addr, body, clen); err != nil {
-				errs <- err
-			}
-		}(keyStorages[i], bytes.NewReader(buf))
+// commitEntry makes ent the entry of key once its value has been written. The
+// current entry of the key is replaced, or archived with versioning. It
+// returns the resulting http status code.
+func (e *Engine) commitEntry(key []byte, current, ent entry.Entry) int {
+	// overwrites and new versions keep the creation time of the key.
+	ent.Created = ent.Modified
+	if current.Status == entry.Exists && !current.Created.IsZero() {
+		ent.Created = current.Created
 	}
 
-	// make sure that every write is done.
-	wg.Wait()
-	close(errs) // close the error channel
+	// the expiry is indexed before the entry, so the reaper always finds it.
+	if !ent.Expires.IsZero() {
+		if err := e.DB.Put(expireKey(key, ent.Expires), nil, nil); err != nil {
+			return http.StatusInternalServerError
+		}
+	}
 
-	// if a single entry is in errors, the whole write process hasn't been successful.
-	if len(errs) != 0 {
-		return 500
+	if e.Versioning {
+		if err := e.archive(key, current); err != nil {
+			return http.StatusInternalServerError
+		}
+
+		v := &versionRecord{ID: ent.Version}
+		v.set(ent)
+		if err := e.putVersion(key, v); err != nil {
+			return http.StatusInternalServerError
+		}
 	}
 
-	// md5 checksum
-	hash := fmt.Sprintf("%x", md5.Sum(buf))
-	if err := e.Put(key, entry.Entry{
-		Storages: e.Storages,
-		Status:   entry.Exists,
-		Hash:     hash,
-	}); err != nil {
+	// without versioning the replaced value is removed.
+	if (!e.Versioning && current.Status == entry.Exists) || current.Trashed() {
+		if err := e.switchEntry(key, current, ent); err != nil {
+			return http.StatusInternalServerError
+		}
+		return http.StatusCreated
+	}
+
+	if err := e.Put(key, ent); err != nil {
 		return http.StatusInternalServerError
 	}
 
@@ -113,19 +240,8 @@ func (e *Engine) DeleteHandler(key []byte) int {
 		return http.StatusInternalServerError
 	}
 
-	failed := false
-
-	hashedKey := entry.HashKey(key)
-
 	// delete the entry from all of the replica servers
-	for _, sto := range ent.Storages {
-		addr := fmt.Sprintf("http://%s%s", sto, hashedKey)
-		if httpdel(addr) != nil {
-			failed = true
-		}
-	}
-
-	if failed {
+	if e.removeValue(key, ent) != nil {
 		return http.StatusInternalServerError
 	}
 
@@ -135,12 +251,176 @@ func (e *Engine) DeleteHandler(key []byte) int {
 	return http.StatusNoContent
 }
 
+// serveRead handles reading the value or the metadata of key. With proxy, the
+// value is streamed through the master instead of redirecting the client to a
+// storage server.
+func (e *Engine) serveRead(w http.ResponseWriter, r *http.Request, key []byte, proxy bool) {
+	q := r.URL.Query()
+	ent := e.Get(key)
+	current := true
+	if q.Has("versionId") {
+		v, ok := e.findVersion(key, ent, q.Get("versionId"))
+		if !ok || v.DeleteMarker {
+			if ok {
+				w.Header().Set(deleteMarkerHeader, "true")
+			}
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		current = ent.Status == entry.Exists && ent.Version == v.ID
+		ent = e.blobEntry(key, v.entry())
+	}
+	hashedKey := ent.Path(key)
+
+	// only the latest version is repaired.
+	readRepair := func(missing []string) {
+		if current {
+			e.readRepair(key, ent, missing)
+		}
+	}
+
+	// set checksum header if exists
+	if len(ent.Hash) != 0 {
+		w.Header().Set(checksumHeader(ent.HashAlgo), ent.Hash)
+	}
+
+	// cannot get value that has been softly or hardly deleted or that has
+	// expired but not yet been reaped.
+	if ent.Status == entry.SoftDeleted || ent.Status == entry.HardDeleted || ent.Expired(time.Now()) {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if e.Versioning {
+		w.Header().Set(versionHeader, versionID(ent.Version))
+	}
+
+	tag := etag(ent)
+	if tag != "" {
+		w.Header().Set("Etag", tag)
+	}
+
+	if ent.ContentType != "" {
+		w.Header().Set("Content-Type", ent.ContentType)
+	}
+	setMetaHeaders(w, ent)
+
+	if !ent.Modified.IsZero() {
+		w.Header().Set("Last-Modified", ent.Modified.Format(http.TimeFormat))
+	}
+
+	if !ent.Expires.IsZero() {
+		w.Header().Set(expiresHeader, ent.Expires.Format(http.TimeFormat))
+	}
+
+	if status := checkConditions(r, ent); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	keyStorages := e.keyStorages(key, ent)
+
+	// set useful extra info in header
+	if shouldBalance(ent.Storages, keyStorages) {
+		w.Header().Set("Balanced", "unbalanced")
+	} else {
+		w.Header().Set("Balanced", "needs balance")
+	}
+
+	w.Header().Set("Storages", strings.Join(ent.Storages, ","))
+
+	// the index knows everything that HEAD returns, so the storages are
+	// only asked if the client wants a read quorum. Entries written before
+	// the size was stored are checked from the storages.
+	if r.Method == http.MethodHead && !ent.Modified.IsZero() && r.Header.Get(readQuorumHeader) == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(ent.Size, 10))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// erasure coded and chunked values are read through the master.
+	if ent.Sharded() {
+		readRepair(e.proxyShards(w, r, key, ent, tag))
+		return
+	}
+
+	if ent.Chunked() {
+		e.proxyChunks(w, r, key, ent, tag)
+		return
+	}
+
+	quorum, valid := parseQuorum(r, readQuorumHeader, e.readQuorum(), e.ReplicaCount)
+	if !valid {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// with a quorum of one, the proxy finds a storage that has the value by
+	// itself.
+	if proxy && quorum == 1 {
+		readRepair(e.proxy(w, r, shuffle(ent.Storages), hashedKey, tag, valueSize(ent)))
+		return
+	}
+
+	found, missing := e.findReplicas(ent.Storages, hashedKey, quorum)
+	readRepair(missing)
+
+	if len(found) == 0 {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(found) < quorum {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// storages that clients cannot access directly are always proxied.
+	loc, ok := e.volume(found[0]).(volume.Locator)
+	if proxy || !ok {
+		readRepair(e.proxy(w, r, found, hashedKey, tag, valueSize(ent)))
+		return
+	}
+
+	// redirect the request to the storage server.
+	w.Header().Set("Location", loc.URL(hashedKey))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
 func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	key := []byte(r.URL.Path)
 
-	// ensure that no other actions are being done on that key.
-	if r.Method == http.MethodGet || r.Method == http.MethodPut ||
-		r.Method == http.MethodDelete {
+	if r.Method == http.MethodGet && r.URL.Path == "/" {
+		q := r.URL.Query()
+		if q.Has("list") {
+			e.serveList(w, r)
+			return
+		}
+
+		if q.Has("stats") {
+			e.serveStats(w, r)
+			return
+		}
+	}
+
+	// multipart uploads lock the upload instead of the key, see upload.go.
+	if uploadRequest(r) {
+		e.serveUpload(w, r, key)
+		return
+	}
+
+	// ensure that no other actions are being done on that key. Values are
+	// never modified in place, so reads don't need the lock and keep reading
+	// the old value while it's being overwritten.
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete ||
+		r.Method == http.MethodPost || r.Method == http.MethodPatch {
 		if err := e.LockKey(r.URL.Path); err != nil {
 			w.WriteHeader(http.StatusConflict)
 			return
@@ -148,72 +428,109 @@ func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		defer e.RemoveLock(r.URL.Path)
 	}
 
+	q := r.URL.Query()
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
-		hashedKey := entry.HashKey(key)
-		ent := e.Get(key)
-		var addr string
-
-		// set md5 checksum header if exists
-		if len(ent.Hash) != 0 {
-			w.Header().Set("Content-Md5", ent.Hash)
+		if q.Has("versions") {
+			e.serveVersions(w, key)
+			return
 		}
 
-		// cannot get value that has been softly or hardly deleted.
-		if ent.Status == entry.SoftDeleted || ent.Status == entry.HardDeleted {
-			w.Header().Set("Content-Length", "0")
-			w.WriteHeader(http.StatusNotFound)
+		e.serveRead(w, r, key, e.ReadMode == ReadModeProxy)
+	case http.MethodPut:
+		// no content length. Erasure coding needs the length up front.
+		if r.ContentLength == 0 || (e.DataShards > 0 && r.ContentLength < 0) {
+			w.WriteHeader(http.StatusLengthRequired)
 			return
 		}
 
-		keyStorages := entry.KeyToStorage(key, e.Storages, e.ReplicaCount, e.SubstorageCount)
+		// check if the key is deleted, or it already exists.
+		ent := e.Get(key)
+		if status := checkConditions(r, ent); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
 
-		// set useful extra info in header
-		if shouldBalance(ent.Storages, keyStorages) {
-			w.Header().Set("Balanced", "unbalanced")
-		} else {
-			w.Header().Set("Balanced", "needs balance")
+		if !e.canReplace(r, ent) {
+			w.WriteHeader(http.StatusForbidden)
+			return
 		}
 
-		w.Header().Set("Storages", strings.Join(ent.Storages, ","))
+		quorum, valid := parseQuorum(r, writeQuorumHeader, e.writeQuorum(), e.ReplicaCount)
+		if !valid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		ok := false
-		for _, ridx := range rand.Perm(len(ent.Storages)) {
-			addr = fmt.Sprintf("http://%s%s", ent.Storages[ridx], hashedKey)
-			found, _ := httpheader(addr, 1*time.Second)
-			if found {
-				ok = true
-				break
-			}
+		opts := PutOptions{
+			WriteQuorum: quorum,
+			ContentType: r.Header.Get("Content-Type"),
+			Meta:        parseMeta(r.Header),
 		}
 
-		if !ok {
-			w.Header().Set("Content-Length", "0")
-			w.WriteHeader(http.StatusNotFound)
+		if !parseChecksums(r, &opts) {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		// redirect the request to the storage server.
-		w.Header().Set("Location", addr)
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusMovedPermanently)
-	case http.MethodPut:
-		// no content length
-		if r.ContentLength == 0 {
-			w.WriteHeader(http.StatusLengthRequired)
+		if !validMeta(opts.Meta) {
+			w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
 			return
 		}
 
-		// check if the key is deleted, or it already exists
-		ent := e.Get(key)
-		if ent.Status == entry.Exists {
-			w.WriteHeader(http.StatusForbidden)
+		expires, valid := parseExpiry(r)
+		if !valid {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		opts.Expires = expires
 
-		status := e.WriteToStorage(key, r.Body, r.ContentLength)
+		status := e.WriteToStorage(key, r.Body, r.ContentLength, opts)
+		if status == http.StatusCreated && e.Versioning {
+			w.Header().Set(versionHeader, e.Get(key).Version)
+		}
 		w.WriteHeader(status)
+	case http.MethodPatch:
+		e.updateMeta(w, r, key)
+	case http.MethodPost:
+		if q.Has("metadata") {
+			e.updateMeta(w, r, key)
+			return
+		}
+
+		if q.Has("undelete") {
+			w.WriteHeader(e.undelete(key))
+			return
+		}
+
+		if !q.Has("restore") || !q.Has("versionId") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.restore(w, r, key, q.Get("versionId"))
 	case http.MethodDelete:
+		if status := checkConditions(r, e.Get(key)); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		if q.Has("versionId") {
+			e.deleteVersion(w, key, q.Get("versionId"))
+			return
+		}
+
+		// with versioning, existing keys are hidden behind a delete marker.
+		if e.Versioning && e.Get(key).Status == entry.Exists {
+			e.deleteLatest(w, key)
+			return
+		}
+
+		// deleted values are kept in the trash for a while.
+		if e.TrashRetention > 0 {
+			w.WriteHeader(e.trash(key))
+			return
+		}
+
 		status := e.DeleteHandler(key)
 		w.WriteHeader(status)
 	default:
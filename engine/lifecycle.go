@@ -0,0 +1,279 @@
+package engine
+
+// lifecycle.go implements prefix based lifecycle rules. The rules are read from
+// a json file and applied by a periodic scan of the index. A rule can delete
+// the keys under a prefix once they haven't been written for a while, or move
+// them to another group of storages, for example to cheaper cold storage. The
+// first rule whose prefix matches a key is applied to it. Every action taken is
+// written into an audit log.
+//
+//	{
+//	  "groups": {"cold": ["http://cold1:80", "http://cold2:80"]},
+//	  "rules": [
+//	    {"prefix": "/tmp/", "expireAfter": "7d"},
+//	    {"prefix": "/logs/", "transitionAfter": "30d", "group": "cold"}
+//	  ]
+//	}
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+)
+
+const (
+	actionExpire     = "expire"
+	actionTransition = "transition"
+)
+
+// Duration is a duration in the lifecycle configuration. In addition to the
+// units of time.ParseDuration, whole days can be given as for example 7d.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LifecycleRule applies to the keys beginning with Prefix. The age of a value
+// is the time since it was last written.
+type LifecycleRule struct {
+	Prefix string `json:"prefix"`
+
+	// ExpireAfter deletes values older than it. Zero disables expiry.
+	ExpireAfter Duration `json:"expireAfter,omitempty"`
+
+	// TransitionAfter moves values older than it to the storage group Group.
+	// Zero disables moving.
+	TransitionAfter Duration `json:"transitionAfter,omitempty"`
+	Group           string   `json:"group,omitempty"`
+}
+
+// action returns the action the rule takes on an entry at the given time, or
+// an empty string if there is nothing to do. Values without a known
+// modification time are left alone.
+func (r *LifecycleRule) action(ent entry.Entry, now time.Time) string {
+	if ent.Status != entry.Exists || ent.Modified.IsZero() {
+		return ""
+	}
+
+	age := now.Sub(ent.Modified)
+	if r.ExpireAfter > 0 && age >= time.Duration(r.ExpireAfter) {
+		return actionExpire
+	}
+
+	// deduplicated values share their blob with values that may stay.
+	if r.TransitionAfter > 0 && age >= time.Duration(r.TransitionAfter) && ent.Group != r.Group && !ent.Dedup {
+		return actionTransition
+	}
+
+	return ""
+}
+
+// Lifecycle is the lifecycle configuration of the engine.
+type Lifecycle struct {
+	// Groups are the storage groups the rules can move values to.
+	Groups map[string][]string `json:"groups"`
+	Rules  []LifecycleRule     `json:"rules"`
+}
+
+// LoadLifecycle reads and validates a lifecycle configuration file.
+func LoadLifecycle(path string) (*Lifecycle, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lc Lifecycle
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, err
+	}
+
+	for name, storages := range lc.Groups {
+		if name == "" || len(storages) == 0 {
+			return nil, errors.New("storage groups need a name and storages")
+		}
+	}
+
+	for i := range lc.Rules {
+		r := &lc.Rules[i]
+
+		// object keys always begin with a slash, same as in listings.
+		if !strings.HasPrefix(r.Prefix, "/") {
+			r.Prefix = "/" + r.Prefix
+		}
+
+		if r.ExpireAfter <= 0 && r.TransitionAfter <= 0 {
+			return nil, fmt.Errorf("rule %s has no actions", r.Prefix)
+		}
+
+		if r.TransitionAfter > 0 {
+			if _, ok := lc.Groups[r.Group]; !ok {
+				return nil, fmt.Errorf("rule %s moves values to an unknown group %q", r.Prefix, r.Group)
+			}
+		}
+	}
+
+	return &lc, nil
+}
+
+// rule returns the first rule matching key.
+func (lc *Lifecycle) rule(key []byte) *LifecycleRule {
+	for i := range lc.Rules {
+		if strings.HasPrefix(string(key), lc.Rules[i].Prefix) {
+			return &lc.Rules[i]
+		}
+	}
+	return nil
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Key    string    `json:"key"`
+	Rule   string    `json:"rule"`
+	Group  string    `json:"group,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (e *Engine) audit(rec auditRecord) {
+	if e.AuditLog == nil {
+		log.Printf("lifecycle: %s %s by rule %s %s\n", rec.Action, rec.Key, rec.Rule, rec.Error)
+		return
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	if _, err := e.AuditLog.Write(append(b, '\n')); err != nil {
+		log.Printf("lifecycle: failed writing audit log: %s\n", err)
+	}
+}
+
+// transition moves the value of key to the storages of a group. The value is
+// copied before the entry is updated, so it stays readable during the move.
+func (e *Engine) transition(key []byte, ent entry.Entry, group string) error {
+	ent.Group = group
+	keyStorages := e.keyStorages(key, ent)
+	if !e.balance(breq{key: key, ent: ent, keyStorages: keyStorages}) {
+		return errors.New("failed copying the value")
+	}
+
+	// the entry points to the copied files once balanced.
+	ent = e.Get(key)
+	ent.Group = group
+	if err := e.Put(key, ent); err != nil {
+		return err
+	}
+
+	// the record of the current version points to the same files.
+	if ent.Version != "" {
+		if v, err := e.getVersion(key, ent.Version); err == nil {
+			v.set(ent)
+			return e.putVersion(key, v)
+		}
+	}
+	return nil
+}
+
+// applyRule applies a rule to key if the rule still has something to do once
+// the key is locked.
+func (e *Engine) applyRule(key []byte, r *LifecycleRule) {
+	if err := e.LockKey(string(key)); err != nil {
+		// try again on the next scan.
+		return
+	}
+	defer e.RemoveLock(string(key))
+
+	ent := e.Get(key)
+	rec := auditRecord{Time: time.Now().UTC(), Action: r.action(ent, time.Now()), Key: string(key), Rule: r.Prefix}
+
+	var err error
+	switch rec.Action {
+	case actionExpire:
+		err = e.expire(key)
+	case actionTransition:
+		rec.Group = r.Group
+		if err = e.transition(key, ent, r.Group); err == nil {
+			e.counters.transitions.Add(1)
+		}
+	default:
+		return
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	e.audit(rec)
+}
+
+// ApplyLifecycle scans the index and applies the lifecycle rules to every key.
+func (e *Engine) ApplyLifecycle() {
+	if e.Lifecycle == nil || len(e.Lifecycle.Rules) == 0 {
+		return
+	}
+
+	type due struct {
+		key  []byte
+		rule *LifecycleRule
+	}
+
+	// the keys are collected first, so the scan doesn't hold the iterator
+	// while values are copied.
+	now := time.Now()
+	keys := make([]due, 0)
+
+	it := e.DB.NewIterator(objectRange, nil)
+	for it.Next() {
+		r := e.Lifecycle.rule(it.Key())
+		if r == nil || r.action(entry.EntryFromBytes(it.Value()), now) == "" {
+			continue
+		}
+
+		key := make([]byte, len(it.Key()))
+		copy(key, it.Key())
+		keys = append(keys, due{key, r})
+	}
+	it.Release()
+
+	for _, d := range keys {
+		e.applyRule(d.key, d.rule)
+	}
+}
+
+// LifecycleWorker applies the lifecycle rules every interval. A value is moved
+// or expired on the first pass after its rule has become due.
+func (e *Engine) LifecycleWorker(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.ApplyLifecycle()
+	}
+}
@@ -0,0 +1,138 @@
+package engine
+
+// list.go implements key listing on top of the leveldb index. Listing is
+// requested with GET /?list and supports the following query parameters:
+// - prefix: only list keys starting with the prefix.
+// - start: continuation token returned by a previous listing.
+// - limit: maximum amount of keys and prefixes to return.
+// - delimiter: roll up keys containing the delimiter after the prefix into a
+//   single common prefix, similarly to directories.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// ListKey describes a single key in a listing. The metadata is missing for
+// values written before it was stored in the index.
+type ListKey struct {
+	Key         string     `json:"key"`
+	Size        int64      `json:"size,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	ETag        string     `json:"etag,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+}
+
+// ListResult is the result of a listing. If Next is not empty, there are more
+// keys to list and Next should be passed as the start of the next listing.
+type ListResult struct {
+	Keys     []ListKey `json:"keys"`
+	Prefixes []string  `json:"prefixes,omitempty"`
+	Next     string    `json:"next,omitempty"`
+}
+
+// List walks the index in key order starting from start and returns at most
+// limit keys and common prefixes. Entries that are not fully written, are
+// being deleted or have expired are skipped.
+func (e *Engine) List(prefix, start, delimiter string, limit int) ListResult {
+	res := ListResult{Keys: []ListKey{}}
+
+	// all of the object keys begin with a slash, since they're url paths.
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	it := e.DB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer it.Release()
+
+	var valid bool
+	if start > prefix {
+		valid = it.Seek([]byte(start))
+	} else {
+		valid = it.First()
+	}
+
+	now := time.Now()
+	for valid {
+		key := string(it.Key())
+
+		// dead and expired entries are skipped before anything else, so that
+		// common prefixes contain a live key and the next page starts at one.
+		ent := entry.EntryFromBytes(it.Value())
+		if ent.Status != entry.Exists || ent.Expired(now) {
+			valid = it.Next()
+			continue
+		}
+
+		if len(res.Keys)+len(res.Prefixes) >= limit {
+			res.Next = key
+			break
+		}
+
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				common := key[:len(prefix)+idx+len(delimiter)]
+				res.Prefixes = append(res.Prefixes, common)
+
+				// skip over every key sharing the common prefix.
+				limitKey := util.BytesPrefix([]byte(common)).Limit
+				if limitKey == nil {
+					break
+				}
+				valid = it.Seek(limitKey)
+				continue
+			}
+		}
+
+		lk := ListKey{
+			Key:         key,
+			Size:        ent.Size,
+			ContentType: ent.ContentType,
+			ETag:        etag(ent),
+		}
+
+		if !ent.Modified.IsZero() {
+			lk.Modified = &ent.Modified
+		}
+		res.Keys = append(res.Keys, lk)
+		valid = it.Next()
+	}
+
+	return res
+}
+
+// serveList handles the listing request and writes the result as json.
+func (e *Engine) serveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	res := e.List(q.Get("prefix"), q.Get("start"), q.Get("delimiter"), limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,100 @@
+package engine
+
+// metadata.go implements user defined metadata. Headers beginning with
+// X-Jakaja-Meta- are stored in the index when writing a value and returned
+// when reading it. The metadata can be updated without rewriting the value
+// with PATCH /$KEY or POST /$KEY?metadata. The headers of the update are merged
+// into the existing metadata and an empty header removes the name.
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/nireo/jakaja/entry"
+)
+
+const (
+	metaHeaderPrefix = "X-Jakaja-Meta-"
+
+	// maxMetaSize limits the total size of the names and values of the
+	// metadata, since it's stored in the index.
+	maxMetaSize = 8 << 10
+)
+
+// parseMeta returns the metadata headers of a request with lower case names
+// without the header prefix.
+func parseMeta(h http.Header) map[string]string {
+	var meta map[string]string
+	for name, values := range h {
+		if !strings.HasPrefix(name, metaHeaderPrefix) || len(name) == len(metaHeaderPrefix) {
+			continue
+		}
+
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name[len(metaHeaderPrefix):])] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+func validMeta(meta map[string]string) bool {
+	size := 0
+	for name, value := range meta {
+		size += len(name) + len(value)
+	}
+	return size <= maxMetaSize
+}
+
+// setMetaHeaders sets the metadata of an entry as response headers.
+func setMetaHeaders(w http.ResponseWriter, ent entry.Entry) {
+	for name, value := range ent.Meta {
+		w.Header().Set(metaHeaderPrefix+name, value)
+	}
+}
+
+// updateMeta merges the metadata headers of the request into the metadata of
+// key.
+func (e *Engine) updateMeta(w http.ResponseWriter, r *http.Request, key []byte) {
+	ent := e.Get(key)
+	if ent.Status != entry.Exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if status := checkConditions(r, ent); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	meta := make(map[string]string, len(ent.Meta))
+	for name, value := range ent.Meta {
+		meta[name] = value
+	}
+
+	for name, value := range parseMeta(r.Header) {
+		if value == "" {
+			delete(meta, name)
+		} else {
+			meta[name] = value
+		}
+	}
+
+	if !validMeta(meta) {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	ent.Meta = meta
+	if len(meta) == 0 {
+		ent.Meta = nil
+	}
+
+	if err := e.Put(key, ent); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setMetaHeaders(w, ent)
+	w.WriteHeader(http.StatusNoContent)
+}
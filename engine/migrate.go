@@ -0,0 +1,49 @@
+package engine
+
+// migrate.go implements rewriting the entries of the index that are still in
+// the legacy string format into the binary format. Both formats are readable,
+// so the migration can be run at any time and it can be interrupted.
+
+import (
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// migrateBatchSize is the amount of entries rewritten in a single batch.
+const migrateBatchSize = 1000
+
+// MigrateIndex rewrites every legacy entry in the index in the current format.
+// It returns the amount of rewritten entries.
+func (e *Engine) MigrateIndex() (int, error) {
+	migrated := 0
+	batch := new(leveldb.Batch)
+
+	it := e.DB.NewIterator(objectRange, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if !entry.IsLegacy(it.Value()) {
+			continue
+		}
+
+		ent := entry.EntryFromBytes(it.Value())
+		batch.Put(it.Key(), ent.ToBytes())
+
+		if batch.Len() >= migrateBatchSize {
+			if err := e.DB.Write(batch, nil); err != nil {
+				return migrated, err
+			}
+			migrated += batch.Len()
+			batch.Reset()
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return migrated, err
+	}
+
+	if err := e.DB.Write(batch, nil); err != nil {
+		return migrated, err
+	}
+	return migrated + batch.Len(), nil
+}
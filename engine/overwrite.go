@@ -0,0 +1,190 @@
+package engine
+
+// overwrite.go implements atomic overwrites of existing keys. The new value is
+// written into a new path on the storages while the old value stays readable.
+// Once the write has finished, the entry is switched to the new path in a
+// single index write and the old files are queued for garbage collection. The
+// old files are kept for a while, so that reads that were redirected to them or
+// that are still streaming them don't fail.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	overwriteHeader = "X-Jakaja-Overwrite"
+
+	// defaultGCDelay is used when the engine doesn't define a gc delay.
+	defaultGCDelay = time.Minute
+)
+
+// pathPrefix marks the ids of the paths of values written without
+// versioning. The ids only keep a new value apart from the files of the value
+// it replaces, so they're not rebuilt into versions.
+const pathPrefix = "p"
+
+// pathID returns the id of a new path for the value of key. With versioning,
+// the id is a new version id.
+func (e *Engine) pathID(key []byte) string {
+	id := e.newVersionID(key)
+	if e.Versioning {
+		return id
+	}
+	return pathPrefix + id
+}
+
+// gcPrefix is the key namespace of the files waiting for garbage collection.
+var gcPrefix = []byte("gc:")
+
+// gcItem is a replaced value whose files are removed once it's due.
+type gcItem struct {
+	Path     string    `json:"path"`
+	Storages []string  `json:"storages"`
+	Due      time.Time `json:"due"`
+
+	// Sharded items have the shard files of an erasure coded value, with the
+	// i'th shard on the i'th storage.
+	Sharded bool `json:"sharded,omitempty"`
+
+	// Chunks are the chunks of a chunked value.
+	Chunks []entry.Chunk `json:"chunks,omitempty"`
+
+	// Blob items release a reference to the blob at Path instead of removing
+	// files, see dedup.go.
+	Blob bool `json:"blob,omitempty"`
+}
+
+// storedFile is a file of a value on a storage.
+type storedFile struct {
+	storage string
+	path    string
+}
+
+// valueFiles returns the files of a value stored at path. The replicas of a
+// value share the path, while shards and chunks have their own.
+func valueFiles(path string, storages []string, sharded bool, chunks []entry.Chunk) []storedFile {
+	files := make([]storedFile, 0, len(storages))
+	for i, s := range storages {
+		switch {
+		case s == "":
+		case sharded:
+			files = append(files, storedFile{s, entry.ShardPath(path, i)})
+		default:
+			files = append(files, storedFile{s, path})
+		}
+	}
+
+	for i, c := range chunks {
+		for _, s := range c.Storages {
+			files = append(files, storedFile{s, c.Path(path, i)})
+		}
+	}
+	return files
+}
+
+// entryFiles returns the files of the value of an entry.
+func entryFiles(key []byte, ent entry.Entry) []storedFile {
+	return valueFiles(ent.Path(key), ent.Storages, ent.Sharded(), ent.Chunks)
+}
+
+// dbKey orders the items by their due time, so that the due items are at the
+// start of the namespace.
+func (it *gcItem) dbKey() []byte {
+	k := make([]byte, 0, len(gcPrefix)+17+len(it.Path))
+	k = append(k, gcPrefix...)
+	k = append(k, fmt.Sprintf("%016x", it.Due.UnixNano())...)
+	k = append(k, 0)
+	return append(k, it.Path...)
+}
+
+func (e *Engine) gcDelay() time.Duration {
+	if e.GCDelay > 0 {
+		return e.GCDelay
+	}
+	return defaultGCDelay
+}
+
+// switchEntry replaces the entry of key with ent and queues the files of the
+// old entry for garbage collection in a single index write.
+func (e *Engine) switchEntry(key []byte, old, ent entry.Entry) error {
+	item := &gcItem{
+		Path:     old.Path(key),
+		Storages: old.Storages,
+		Due:      time.Now().Add(e.gcDelay()),
+		Sharded:  old.Sharded(),
+		Chunks:   old.Chunks,
+		Blob:     old.Dedup,
+	}
+
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(key, ent.ToBytes())
+	batch.Put(item.dbKey(), b)
+	return e.DB.Write(batch, nil)
+}
+
+// CollectGarbage removes the replaced files that are due.
+func (e *Engine) CollectGarbage() {
+	now := time.Now()
+	items := make([]*gcItem, 0)
+
+	it := e.DB.NewIterator(util.BytesPrefix(gcPrefix), nil)
+	for it.Next() {
+		var item gcItem
+		if err := json.Unmarshal(it.Value(), &item); err != nil {
+			log.Printf("gc: invalid item: %s\n", err)
+			continue
+		}
+
+		if item.Due.After(now) {
+			break
+		}
+		items = append(items, &item)
+	}
+	it.Release()
+
+	for _, item := range items {
+		if item.Blob {
+			if err := e.releaseBlob(item.Path); err != nil {
+				log.Printf("gc: failed releasing %s: %s\n", item.Path, err)
+			} else {
+				e.DB.Delete(item.dbKey(), nil)
+			}
+			continue
+		}
+
+		failed := false
+		for _, f := range valueFiles(item.Path, item.Storages, item.Sharded, item.Chunks) {
+			if err := e.volume(f.storage).Delete(context.Background(), f.path); err != nil {
+				log.Printf("gc: failed deleting %s from %s: %s\n", f.path, f.storage, err)
+				failed = true
+			}
+		}
+
+		// failed items are tried again on the next round.
+		if !failed {
+			e.DB.Delete(item.dbKey(), nil)
+		}
+	}
+}
+
+// GCWorker removes the files of replaced values every interval, once they
+// have waited for the garbage collection delay.
+func (e *Engine) GCWorker(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.CollectGarbage()
+	}
+}
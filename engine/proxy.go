@@ -0,0 +1,262 @@
+package engine
+
+// proxy.go implements the proxy read mode in which the master streams the
+// value from a storage server to the client instead of redirecting the client
+// to the storage server. If a storage server fails in the middle of a request,
+// the rest of the value is read from another replica.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+)
+
+const (
+	// ReadModeRedirect redirects clients to the storage servers.
+	ReadModeRedirect = "redirect"
+
+	// ReadModeProxy streams values through the master.
+	ReadModeProxy = "proxy"
+)
+
+var errNoReplica = errors.New("no replica left to read from")
+
+// replicaReader reads a value that is stored on multiple storages. The value
+// is read from the first storage and if that fails, the reading continues from
+// the same offset on the next storage.
+type replicaReader struct {
+	ctx      context.Context
+	e        *Engine
+	storages []string
+	path     string
+	size     int64
+
+	// rc reads the current storage from pos. Seeking only moves offset, so
+	// that seeking back and forth before reading doesn't reopen the value.
+	idx     int
+	offset  int64
+	pos     int64
+	rc      io.ReadCloser
+	missing []string
+}
+
+// open opens the value on the current storage from the current offset. If the
+// size of the value isn't known yet, it's taken from the storage.
+func (rr *replicaReader) open() error {
+	storage := rr.storages[rr.idx]
+	rc, err := rr.e.volume(storage).Get(rr.ctx, rr.path, rr.offset, -1)
+	if err != nil {
+		if errors.Is(err, volume.ErrNotFound) {
+			rr.missing = append(rr.missing, storage)
+		}
+		log.Printf("proxy: cannot read from %s: %s\n", storage, err)
+		return err
+	}
+
+	if rr.size < 0 {
+		size := int64(-1)
+		if s, ok := rc.(volume.Sized); ok {
+			size = s.Size()
+		}
+
+		if size < 0 {
+			ctx, cancel := context.WithTimeout(rr.ctx, headTimeout)
+			size, err = rr.e.volume(storage).Head(ctx, rr.path)
+			cancel()
+
+			if err != nil {
+				rc.Close()
+				log.Printf("proxy: cannot read the size from %s: %s\n", storage, err)
+				return err
+			}
+		}
+		rr.size = size
+	}
+
+	rr.rc, rr.pos = rc, rr.offset
+	return nil
+}
+
+func (rr *replicaReader) Read(p []byte) (int, error) {
+	for {
+		if rr.offset >= rr.size {
+			return 0, io.EOF
+		}
+
+		if rr.rc != nil && rr.pos != rr.offset {
+			rr.rc.Close()
+			rr.rc = nil
+		}
+
+		if rr.rc == nil {
+			if rr.idx >= len(rr.storages) {
+				return 0, errNoReplica
+			}
+
+			if err := rr.open(); err != nil {
+				rr.idx++
+				continue
+			}
+		}
+
+		n, err := rr.rc.Read(p)
+		rr.offset += int64(n)
+		rr.pos += int64(n)
+		if err == nil || (err == io.EOF && rr.offset >= rr.size) {
+			return n, err
+		}
+
+		// the storage failed or the value ended too early, so continue from the
+		// next storage.
+		log.Printf("proxy: storage %s failed at offset %d: %v\n", rr.storages[rr.idx], rr.offset, err)
+		rr.rc.Close()
+		rr.rc = nil
+		rr.idx++
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (rr *replicaReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.offset
+	case io.SeekEnd:
+		offset += rr.size
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative offset")
+	}
+
+	rr.offset = offset
+	return offset, nil
+}
+
+func (rr *replicaReader) Close() error {
+	if rr.rc != nil {
+		return rr.rc.Close()
+	}
+	return nil
+}
+
+// rangeStart returns the first byte of the range requested by r, or zero if r
+// doesn't request a single range from a known offset.
+func rangeStart(r *http.Request) int64 {
+	spec := r.Header.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0
+	}
+
+	first, _, _ := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	n, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// openReplicas opens a reader for the value at path on the first of the
+// storages that has it. The value is requested from offset with a single read,
+// so that it's not read twice. The size of the value is taken from the storage
+// if it's negative. The reader is nil if none of the storages have the value.
+// It returns the storages that were missing the value.
+func (e *Engine) openReplicas(ctx context.Context, storages []string, path string, size, offset int64) (*replicaReader, []string) {
+	rr := &replicaReader{
+		ctx:      ctx,
+		e:        e,
+		storages: storages,
+		path:     path,
+		size:     size,
+		offset:   offset,
+		missing:  make([]string, 0),
+	}
+
+	for ; rr.idx < len(storages); rr.idx++ {
+		if rr.open() == nil {
+			return rr, rr.missing
+		}
+	}
+
+	return nil, rr.missing
+}
+
+// valueSize returns the size of the value of an entry, or -1 if the entry was
+// written before the size was stored.
+func valueSize(ent entry.Entry) int64 {
+	if ent.Modified.IsZero() {
+		return -1
+	}
+	return ent.Size
+}
+
+// openValue opens a reader for the value of an entry, however it's stored. The reader is nil if the value cannot be read.
+func (e *Engine) openValue(ctx context.Context, key []byte, ent entry.Entry) (io.ReadSeekCloser, int64) {
+	if ent.Sharded() {
+		sr, err := e.openShards(ctx, key, ent)
+		if err != nil {
+			return nil, 0
+		}
+		return sr, ent.Size
+	}
+
+	if ent.Chunked() {
+		cr := e.openChunks(ctx, key, ent)
+		return cr, cr.size
+	}
+
+	rr, _ := e.openReplicas(ctx, ent.Storages, ent.Path(key), valueSize(ent), 0)
+	if rr == nil {
+		return nil, 0
+	}
+	return rr, rr.size
+}
+
+// proxy streams the value at path from the first storage in storages that has
+// it. If reading the value fails midway, the remaining bytes are read from the
+// next storages. The value is requested from the start of the requested range
+// with a single read, so that it's not read twice. Range and conditional
+// requests are handled using the etag. The size is asked from the storages if
+// it's negative. The content type given by the storage is used for values
+// written without one. It returns the storages that were missing the value.
+func (e *Engine) proxy(w http.ResponseWriter, r *http.Request, storages []string, path, etag string, size int64) []string {
+	rr, missing := e.openReplicas(r.Context(), storages, path, size, rangeStart(r))
+	if rr == nil {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return missing
+	}
+	defer rr.Close()
+
+	if t, ok := rr.rc.(volume.Typed); ok && w.Header().Get("Content-Type") == "" && t.ContentType() != "" {
+		w.Header().Set("Content-Type", t.ContentType())
+	}
+
+	serveValue(w, r, rr, etag)
+	return rr.missing
+}
+
+// serveValue streams a value read through the master to the client. Range and
+// conditional requests are handled using the etag.
+func serveValue(w http.ResponseWriter, r *http.Request, value io.ReadSeeker, etag string) {
+	if etag != "" {
+		w.Header().Set("Etag", etag)
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, value)
+}
@@ -0,0 +1,93 @@
+package engine
+
+// quorum.go contains helpers for write and read quorums. The write quorum is
+// the amount of storages that need to acknowledge a write for it to succeed and
+// the read quorum is the amount of storages that need to have the value for a
+// read to succeed. Both can be overridden per request using headers.
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nireo/jakaja/volume"
+)
+
+const (
+	writeQuorumHeader = "X-Jakaja-Write-Quorum"
+	readQuorumHeader  = "X-Jakaja-Read-Quorum"
+
+	// headTimeout is how long reads wait for a storage to tell whether it has
+	// a value.
+	headTimeout = 1 * time.Second
+)
+
+func (e *Engine) writeQuorum() int {
+	if e.WriteQuorum > 0 {
+		return e.WriteQuorum
+	}
+	return e.ReplicaCount
+}
+
+func (e *Engine) readQuorum() int {
+	if e.ReadQuorum > 0 {
+		return e.ReadQuorum
+	}
+	return 1
+}
+
+// parseQuorum reads a quorum from the given request header. If the header is not
+// set, def is returned. It returns false if the header is not a number between 1
+// and max.
+func parseQuorum(r *http.Request, header string, def, max int) (int, bool) {
+	v := r.Header.Get(header)
+	if v == "" {
+		return def, true
+	}
+
+	quorum, err := strconv.Atoi(v)
+	if err != nil || quorum < 1 || quorum > max {
+		return 0, false
+	}
+	return quorum, true
+}
+
+// shuffle returns the storages in a random order.
+func shuffle(storages []string) []string {
+	shuffled := make([]string, 0, len(storages))
+	for _, ridx := range rand.Perm(len(storages)) {
+		shuffled = append(shuffled, storages[ridx])
+	}
+	return shuffled
+}
+
+// findReplicas checks the storages in a random order and returns the first
+// quorum storages that have the given path. It also returns the storages that
+// were found to be missing the path along the way.
+func (e *Engine) findReplicas(storages []string, path string, quorum int) ([]string, []string) {
+	found := make([]string, 0, quorum)
+	missing := make([]string, 0)
+	for _, s := range shuffle(storages) {
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(s).Head(ctx, path)
+		cancel()
+
+		if errors.Is(err, volume.ErrNotFound) {
+			missing = append(missing, s)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		found = append(found, s)
+		if len(found) == quorum {
+			break
+		}
+	}
+	return found, missing
+}
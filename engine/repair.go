@@ -0,0 +1,305 @@
+package engine
+
+// repair.go implements a persistent repair queue for replicas that are missing
+// a value, for example because the storage server was down during the write.
+// The queue is stored in the index database under its own key namespace, so
+// it survives restarts. A background worker goes through the queue and copies
+// the values from a healthy replica, backing off exponentially on failures.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	minRepairBackoff = 10 * time.Second
+	maxRepairBackoff = 1 * time.Hour
+
+	// readRepairLockWait is how long a read repair waits for the key lock
+	// before leaving the repair to the repair worker.
+	readRepairLockWait = 10 * time.Second
+)
+
+// repairPrefix is the key namespace of the repair queue. Object keys always
+// begin with a slash, so the namespaces cannot overlap.
+var repairPrefix = []byte("repair:")
+
+// repairItem is a single storage that is missing the value of a key.
+type repairItem struct {
+	Key      string    `json:"key"`
+	Storage  string    `json:"storage"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+}
+
+func (it *repairItem) dbKey() []byte {
+	k := make([]byte, 0, len(repairPrefix)+len(it.Key)+len(it.Storage)+1)
+	k = append(k, repairPrefix...)
+	k = append(k, it.Key...)
+	k = append(k, 0)
+	return append(k, it.Storage...)
+}
+
+func (e *Engine) putRepair(it *repairItem) error {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return e.DB.Put(it.dbKey(), b, nil)
+}
+
+// queueRepair adds the storages that are missing the value of key into the
+// repair queue.
+func (e *Engine) queueRepair(key []byte, storages []string) {
+	for _, s := range storages {
+		it := &repairItem{Key: string(key), Storage: s, Next: time.Now()}
+		if err := e.putRepair(it); err != nil {
+			log.Printf("failed to queue repair of %s on %s: %s\n", key, s, err)
+		}
+	}
+}
+
+// missingStorages returns the storages in keyStorages that are not in storages.
+func missingStorages(storages, keyStorages []string) []string {
+	missing := make([]string, 0)
+	for _, s1 := range keyStorages {
+		found := false
+		for _, s2 := range storages {
+			if s1 == s2 {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, s1)
+		}
+	}
+	return missing
+}
+
+// orderStorages orders storages such that the storages in keyStorages come
+// first in the same order as in keyStorages.
+func orderStorages(storages, keyStorages []string) []string {
+	ordered := make([]string, 0, len(storages))
+	for _, s1 := range keyStorages {
+		for _, s2 := range storages {
+			if s1 == s2 {
+				ordered = append(ordered, s1)
+				break
+			}
+		}
+	}
+	return append(ordered, missingStorages(keyStorages, storages)...)
+}
+
+// copyValue streams the file at path from one storage to another.
+func (e *Engine) copyValue(from, to, path string) error {
+	return volume.Copy(context.Background(), e.volume(from), e.volume(to), path)
+}
+
+// repair copies the value of the item's key into the item's storage. It
+// returns true if the item can be removed from the queue. The caller must hold
+// the key lock.
+func (e *Engine) repair(it *repairItem) bool {
+	key := []byte(it.Key)
+	ent := e.Get(key)
+	if ent.Status != entry.Exists {
+		return true
+	}
+
+	if ent.Sharded() {
+		return e.repairShard(key, ent, it.Storage)
+	}
+
+	if ent.Chunked() {
+		return e.repairChunks(key, ent, it.Storage)
+	}
+
+	path := ent.Path(key)
+	listed := len(missingStorages(ent.Storages, []string{it.Storage})) == 0
+
+	// reads queue repairs for storages that are in the entry, but are missing
+	// the file.
+	if listed {
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(it.Storage).Head(ctx, path)
+		cancel()
+
+		if err == nil {
+			return true
+		}
+	}
+
+	err := fmt.Errorf("no healthy replica")
+	for _, s := range missingStorages([]string{it.Storage}, ent.Storages) {
+		if err = e.copyValue(s, it.Storage, path); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		log.Printf("repair: failed copying %s to %s: %s\n", key, it.Storage, err)
+		e.counters.repairsFailed.Add(1)
+		return false
+	}
+
+	if !listed {
+		keyStorages := e.keyStorages(key, ent)
+		ent.Storages = orderStorages(append(ent.Storages, it.Storage), keyStorages)
+
+		// the storages of deduplicated values are in the record of the blob.
+		if ent.Dedup {
+			err = e.setBlobStorages(key, ent)
+		} else {
+			err = e.Put(key, ent)
+		}
+
+		if err != nil {
+			log.Printf("repair: failed updating index for %s: %s\n", key, err)
+			return false
+		}
+	}
+
+	e.counters.repairs.Add(1)
+	return true
+}
+
+// repairShard decodes the shard of an erasure coded value that belongs on
+// storage and writes it there. Shards that were lost before the index was
+// rebuilt have no storage in the entry, so they're placed on the storage
+// where the key belongs.
+func (e *Engine) repairShard(key []byte, ent entry.Entry, storage string) bool {
+	keyStorages := e.keyStorages(key, ent)
+
+	idx := -1
+	for i, s := range ent.Storages {
+		if s == storage || (s == "" && i < len(keyStorages) && keyStorages[i] == storage) {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 {
+		return true
+	}
+
+	if ent.Storages[idx] != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(storage).Head(ctx, ent.FilePath(key, idx))
+		cancel()
+
+		if err == nil {
+			return true
+		}
+	}
+
+	if err := e.rebuildShard(key, ent, idx, storage); err != nil {
+		log.Printf("repair: failed rebuilding shard %d of %s on %s: %s\n", idx, key, storage, err)
+		e.counters.repairsFailed.Add(1)
+		return false
+	}
+
+	if ent.Storages[idx] == "" {
+		ent.Storages[idx] = storage
+		if err := e.Put(key, ent); err != nil {
+			log.Printf("repair: failed updating index for %s: %s\n", key, err)
+			return false
+		}
+	}
+
+	e.counters.repairs.Add(1)
+	return true
+}
+
+// readRepair is called when a read notices that some of the storages in the
+// entry are missing the value. The repairs are queued and attempted right away
+// in the background. If every storage is missing the value, there is nothing to
+// repair from.
+func (e *Engine) readRepair(key []byte, ent entry.Entry, missing []string) {
+	if len(missing) == 0 || len(missing) == len(ent.Storages) {
+		return
+	}
+
+	e.counters.readRepairs.Add(uint64(len(missing)))
+	e.queueRepair(key, missing)
+
+	go func() {
+		// a write may be holding the lock.
+		if err := e.lockKeyWait(string(key), readRepairLockWait); err != nil {
+			return
+		}
+		defer e.RemoveLock(string(key))
+
+		for _, s := range missing {
+			it := &repairItem{Key: string(key), Storage: s}
+			if e.repair(it) {
+				e.DB.Delete(it.dbKey(), nil)
+			}
+		}
+	}()
+}
+
+// Repair goes through the repair queue once and tries to repair every item
+// that is due.
+func (e *Engine) Repair() {
+	now := time.Now()
+	items := make([]*repairItem, 0)
+
+	it := e.DB.NewIterator(util.BytesPrefix(repairPrefix), nil)
+	for it.Next() {
+		var item repairItem
+		if err := json.Unmarshal(it.Value(), &item); err != nil {
+			log.Printf("repair: invalid queue item: %s\n", err)
+			continue
+		}
+
+		if !item.Next.After(now) {
+			items = append(items, &item)
+		}
+	}
+	it.Release()
+
+	for _, item := range items {
+		// a request is using the key, which says nothing about the storage, so
+		// the item is tried again on the next round without backing off.
+		if err := e.LockKey(item.Key); err != nil {
+			continue
+		}
+
+		done := e.repair(item)
+		e.RemoveLock(item.Key)
+
+		if done {
+			e.DB.Delete(item.dbKey(), nil)
+			continue
+		}
+
+		backoff := minRepairBackoff << item.Attempts
+		if backoff > maxRepairBackoff || backoff <= 0 {
+			backoff = maxRepairBackoff
+		}
+		item.Attempts++
+		item.Next = time.Now().Add(backoff)
+
+		if err := e.putRepair(item); err != nil {
+			log.Printf("repair: failed updating queue item: %s\n", err)
+		}
+	}
+}
+
+// RepairWorker processes the repair queue every interval for as long as the
+// process runs.
+func (e *Engine) RepairWorker(interval time.Duration) {
+	for {
+		e.Repair()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,899 @@
+package engine
+
+// s3.go implements a gateway serving a subset of the S3 api on top of the
+// engine, so that S3 clients and tools can be used instead of the native api.
+// Buckets are key prefixes, the object photo.jpg in the bucket images is the
+// key /images/photo.jpg, and they exist implicitly. Requests are path style
+// and authenticated with signature version 4, see sigv4.go. The supported
+// operations are:
+// - ListBuckets, CreateBucket, HeadBucket, DeleteBucket, GetBucketLocation
+// - ListObjects, ListObjectsV2
+// - PutObject, GetObject, HeadObject, DeleteObject, DeleteObjects
+// - CreateMultipartUpload, UploadPart, ListParts, CompleteMultipartUpload,
+//   AbortMultipartUpload, see upload.go
+//
+// Objects are written with the engine's own settings. Reads, deletes and
+// multipart uploads go through the native api and their responses are
+// translated, so versioning, the trash and conditional requests work the same
+// way as with the native api. Values are always streamed through the gateway.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+	s3MetaPrefix = "X-Amz-Meta-"
+
+	// s3MaxXML is the largest xml request body, which fits a delete request
+	// of s3MaxKeys long keys.
+	s3MaxXML = 2 << 20
+)
+
+// s3Error is an error returned to S3 clients.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (err *s3Error) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+var (
+	errAccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key id does not exist"}
+	errSignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	errMalformedAuth     = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed"}
+	errTimeSkewed        = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time"}
+	errRequestExpired    = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errContentSHA256     = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid x-amz-content-sha256"}
+	errMissingLength     = &s3Error{http.StatusLengthRequired, "MissingContentLength", "The content length is required"}
+	errInvalidBucket     = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid"}
+	errInvalidArgument   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errMalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The xml is not well-formed"}
+	errPayloadMismatch   = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The body does not match x-amz-content-sha256"}
+	errBucketNotEmpty    = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket is not empty"}
+	errNotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "The operation is not supported"}
+	errS3Internal        = &s3Error{http.StatusInternalServerError, "InternalError", "Internal error"}
+)
+
+// s3ErrorCode returns the S3 error code of a status of the native api.
+func s3ErrorCode(r *http.Request, status int, notFound string) string {
+	switch status {
+	case http.StatusBadRequest:
+		if r.Method == http.MethodPut {
+			return "BadDigest"
+		}
+		return "InvalidRequest"
+	case http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusNotFound:
+		return notFound
+	case http.StatusMethodNotAllowed:
+		return "MethodNotAllowed"
+	case http.StatusConflict:
+		return "OperationAborted"
+	case http.StatusLengthRequired:
+		return "MissingContentLength"
+	case http.StatusPreconditionFailed:
+		return "PreconditionFailed"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "InvalidRange"
+	case http.StatusRequestHeaderFieldsTooLarge:
+		return "MetadataTooLarge"
+	case http.StatusServiceUnavailable:
+		return "ServiceUnavailable"
+	}
+	return "InternalError"
+}
+
+// S3Credential is an access key of the S3 gateway.
+type S3Credential struct {
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+// LoadS3Credentials reads the access keys of the S3 gateway from a json file
+// containing a list of credentials.
+func LoadS3Credentials(path string) ([]S3Credential, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []S3Credential
+	if err := json.Unmarshal(b, &credentials); err != nil {
+		return nil, err
+	}
+
+	for _, c := range credentials {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, errors.New("credentials need an access key id and a secret access key")
+		}
+	}
+	return credentials, nil
+}
+
+// S3Gateway serves the S3 api on top of an engine.
+type S3Gateway struct {
+	e *Engine
+
+	// credentials maps access key ids to their secrets.
+	credentials map[string]string
+}
+
+// NewS3Gateway creates a gateway which accepts requests signed with the given
+// credentials.
+func NewS3Gateway(e *Engine, credentials []S3Credential) *S3Gateway {
+	g := &S3Gateway{e: e, credentials: make(map[string]string)}
+	for _, c := range credentials {
+		g.credentials[c.AccessKeyID] = c.SecretAccessKey
+	}
+	return g
+}
+
+// s3Key returns the key of an object in a bucket.
+func s3Key(bucket, object string) string {
+	return "/" + bucket + "/" + object
+}
+
+// validBucket reports whether name is a valid bucket name. Bucket names are
+// lower case, so that they're also valid host names.
+func validBucket(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		alnum := 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+		if !alnum && ((c != '-' && c != '.') || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+// decodeXML decodes an xml request body. The digest of a signed body is only
+// verified at its end, so the whole body is read before anything is decoded.
+func decodeXML(body io.Reader, v interface{}) error {
+	b, err := io.ReadAll(io.LimitReader(body, s3MaxXML+1))
+	if errors.Is(err, errChecksum) {
+		return errPayloadMismatch
+	}
+
+	if err != nil || len(b) > s3MaxXML || xml.Unmarshal(b, v) != nil {
+		return errMalformedXML
+	}
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *s3Error
+	if !errors.As(err, &s3err) {
+		s3err = errS3Internal
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Del("Etag")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3err.Status)
+		return
+	}
+
+	writeXML(w, s3err.Status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: s3err.Code, Message: s3err.Message, Resource: r.URL.Path})
+}
+
+// s3Response translates a response of the native api into a response of the
+// S3 api. The headers are renamed and errors are written as S3 errors.
+type s3Response struct {
+	http.ResponseWriter
+	r *http.Request
+
+	// notFound is the error code of a missing key or upload.
+	notFound string
+
+	wroteHeader bool
+	failed      bool
+}
+
+func (sr *s3Response) WriteHeader(status int) {
+	if sr.wroteHeader {
+		return
+	}
+	sr.wroteHeader = true
+
+	translateHeaders(sr.Header())
+	if status >= 400 {
+		sr.failed = true
+		writeS3Error(sr.ResponseWriter, sr.r, &s3Error{
+			Status:  status,
+			Code:    s3ErrorCode(sr.r, status, sr.notFound),
+			Message: http.StatusText(status),
+		})
+		return
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *s3Response) Write(p []byte) (int, error) {
+	sr.WriteHeader(http.StatusOK)
+	if sr.failed {
+		return len(p), nil
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// translateHeaders renames the response headers of the native api to their
+// S3 names. The headers without an S3 counterpart are removed.
+func translateHeaders(h http.Header) {
+	for name, values := range h {
+		switch {
+		case strings.HasPrefix(name, metaHeaderPrefix):
+			delete(h, name)
+			h[s3MetaPrefix+name[len(metaHeaderPrefix):]] = values
+		case name == versionHeader:
+			delete(h, name)
+			h["X-Amz-Version-Id"] = values
+		case name == deleteMarkerHeader:
+			delete(h, name)
+			h["X-Amz-Delete-Marker"] = values
+		case strings.HasPrefix(name, "X-Jakaja-") || name == "Balanced" || name == "Storages":
+			delete(h, name)
+		case name == "Content-Md5":
+			// the checksum of the native api is hex instead of base64.
+			delete(h, name)
+		}
+	}
+}
+
+// bufferedResponse keeps a response of the native api in memory, so that its
+// body can be translated. It's only used for small responses.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	br.WriteHeader(http.StatusOK)
+	return br.body.Write(p)
+}
+
+// native serves a request of the native api into a buffered response.
+func (g *S3Gateway) native(r *http.Request) *bufferedResponse {
+	res := &bufferedResponse{header: make(http.Header)}
+	g.e.ServeHTTP(res, r)
+	translateHeaders(res.header)
+	return res
+}
+
+// nativeRequest translates an S3 request into a request of the native api
+// for key. Only the given query parameters are kept, and the metadata headers
+// are renamed.
+func nativeRequest(r *http.Request, method, key string, body io.Reader, clen int64, params ...string) *http.Request {
+	nr := r.Clone(r.Context())
+	nr.Method = method
+	nr.URL.Path, nr.URL.RawPath = key, ""
+	nr.ContentLength = clen
+	nr.Body = io.NopCloser(body)
+
+	q, nq := r.URL.Query(), url.Values{}
+	for _, p := range params {
+		if q.Has(p) {
+			nq[p] = q[p]
+		}
+	}
+	nr.URL.RawQuery = nq.Encode()
+
+	nr.Header = make(http.Header)
+	for name, values := range r.Header {
+		switch {
+		case strings.HasPrefix(name, s3MetaPrefix):
+			nr.Header[metaHeaderPrefix+name[len(s3MetaPrefix):]] = values
+		case strings.HasPrefix(name, "X-Amz-") || strings.HasPrefix(name, "X-Jakaja-"):
+		case name == "Authorization" || name == "Content-Length":
+		default:
+			nr.Header[name] = values
+		}
+	}
+	return nr
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, clen, err := g.authenticate(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		g.listBuckets(w, r)
+	case !validBucket(bucket):
+		writeS3Error(w, r, errInvalidBucket)
+	case object == "":
+		g.serveBucket(w, r, bucket, body)
+	default:
+		g.serveObject(w, r, bucket, object, body, clen)
+	}
+}
+
+func (g *S3Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, body io.Reader) {
+	params := s3Params(r.URL.Query())
+	switch {
+	case r.Method == http.MethodGet && params["location"]:
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+	case r.Method == http.MethodGet && listRequest(params):
+		g.listObjects(w, r, bucket)
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && len(params) == 0:
+		// buckets exist as long as they have objects.
+		w.Header().Set("Location", "/"+bucket)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && len(params) == 0:
+		if len(g.e.List(s3Key(bucket, ""), "", "", 1).Keys) > 0 {
+			writeS3Error(w, r, errBucketNotEmpty)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && params["delete"]:
+		g.deleteObjects(w, r, bucket, body)
+	default:
+		writeS3Error(w, r, errNotImplemented)
+	}
+}
+
+func (g *S3Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket, object string, body io.Reader, clen int64) {
+	key := s3Key(bucket, object)
+	q := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if q.Has("uploadId") {
+			g.listParts(w, r, bucket, object)
+			return
+		}
+
+		nr := nativeRequest(r, r.Method, key, http.NoBody, 0, "versionId")
+		g.e.serveRead(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchKey"}, nr, []byte(key), true)
+	case http.MethodPut:
+		if q.Has("uploadId") {
+			nr := nativeRequest(r, r.Method, key, body, clen, "uploadId", "partNumber")
+			g.e.ServeHTTP(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchUpload"}, nr)
+			return
+		}
+
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeS3Error(w, r, errNotImplemented)
+			return
+		}
+		g.putObject(w, r, key, body, clen)
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			g.createUpload(w, r, bucket, object)
+		case q.Has("uploadId"):
+			g.completeUpload(w, r, bucket, object, body)
+		default:
+			writeS3Error(w, r, errNotImplemented)
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			nr := nativeRequest(r, r.Method, key, http.NoBody, 0, "uploadId")
+			g.e.ServeHTTP(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchUpload"}, nr)
+			return
+		}
+
+		res := g.deleteObject(r, key, q.Get("versionId"))
+		for name, values := range res.header {
+			w.Header()[name] = values
+		}
+		(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchKey"}).WriteHeader(res.status)
+	default:
+		writeS3Error(w, r, errNotImplemented)
+	}
+}
+
+// putObject writes an object. Unlike with the native api, existing objects
+// are always replaced and empty objects can be written.
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, key string, body io.Reader, clen int64) {
+	if g.e.DataShards > 0 && clen < 0 {
+		writeS3Error(w, r, errMissingLength)
+		return
+	}
+
+	nr := nativeRequest(r, r.Method, key, body, clen)
+	opts := PutOptions{
+		ContentType: nr.Header.Get("Content-Type"),
+		Meta:        parseMeta(nr.Header),
+	}
+
+	if !parseChecksums(nr, &opts) {
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 is not valid"})
+		return
+	}
+
+	if !validMeta(opts.Meta) {
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "MetadataTooLarge", "The metadata is too large"})
+		return
+	}
+
+	if err := g.e.LockKey(key); err != nil {
+		writeS3Error(w, r, &s3Error{http.StatusConflict, "OperationAborted", "The object is being modified"})
+		return
+	}
+	defer g.e.RemoveLock(key)
+
+	sr := &s3Response{ResponseWriter: w, r: r, notFound: "NoSuchKey"}
+	if status := g.e.WriteToStorage([]byte(key), body, clen, opts); status != http.StatusCreated {
+		sr.WriteHeader(status)
+		return
+	}
+
+	ent := g.e.Get([]byte(key))
+	if tag := etag(ent); tag != "" {
+		w.Header().Set("Etag", tag)
+	}
+
+	if g.e.Versioning {
+		w.Header().Set(versionHeader, ent.Version)
+	}
+	sr.WriteHeader(http.StatusOK)
+}
+
+// deleteObject deletes a key through the native api. Deleting an object that
+// doesn't exist succeeds like in S3.
+func (g *S3Gateway) deleteObject(r *http.Request, key, version string) *bufferedResponse {
+	nr := nativeRequest(r, http.MethodDelete, key, http.NoBody, 0)
+	if version != "" {
+		nr.URL.RawQuery = url.Values{"versionId": {version}}.Encode()
+	}
+
+	res := g.native(nr)
+	if res.status == http.StatusNotFound && version == "" {
+		res.status = http.StatusNoContent
+	}
+	return res
+}
+
+type s3DeleteObject struct {
+	Key       string
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+func (g *S3Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string, body io.Reader) {
+	var req struct {
+		Quiet   bool
+		Objects []s3DeleteObject `xml:"Object"`
+	}
+
+	if err := decodeXML(body, &req); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if len(req.Objects) > s3MaxKeys {
+		writeS3Error(w, r, errMalformedXML)
+		return
+	}
+
+	type deleted struct {
+		s3DeleteObject
+		DeleteMarker          bool   `xml:",omitempty"`
+		DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+	}
+
+	type deleteError struct {
+		s3DeleteObject
+		Code    string
+		Message string
+	}
+
+	res := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3Namespace}
+
+	for _, o := range req.Objects {
+		dr := g.deleteObject(r, s3Key(bucket, o.Key), o.VersionID)
+		if dr.status != http.StatusNoContent {
+			res.Errors = append(res.Errors, deleteError{
+				s3DeleteObject: o,
+				Code:           s3ErrorCode(r, dr.status, "NoSuchVersion"),
+				Message:        http.StatusText(dr.status),
+			})
+			continue
+		}
+
+		if !req.Quiet {
+			d := deleted{s3DeleteObject: o}
+			if dr.header.Get("X-Amz-Delete-Marker") == "true" {
+				d.DeleteMarker = true
+				d.DeleteMarkerVersionID = dr.header.Get("X-Amz-Version-Id")
+			}
+			res.Deleted = append(res.Deleted, d)
+		}
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
+
+// s3Params returns the names of the query parameters of an operation, which
+// are the parameters that don't belong to the signature.
+func s3Params(q url.Values) map[string]bool {
+	params := make(map[string]bool)
+	for name := range q {
+		if !strings.HasPrefix(name, "X-Amz-") && name != "x-id" {
+			params[name] = true
+		}
+	}
+	return params
+}
+
+// listRequest reports whether the parameters of a bucket request are the
+// parameters of a listing.
+func listRequest(params map[string]bool) bool {
+	for name := range params {
+		switch name {
+		case "list-type", "prefix", "delimiter", "max-keys", "marker", "start-after",
+			"continuation-token", "encoding-type", "fetch-owner":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// listAfter returns the key where a listing continuing after marker starts.
+// S3 markers are exclusive, unlike the start of a listing. A common prefix as
+// the marker skips every key beginning with it.
+func listAfter(marker, delimiter string) string {
+	if delimiter != "" && strings.HasSuffix(marker, delimiter) {
+		if limit := util.BytesPrefix([]byte(marker)).Limit; limit != nil {
+			return string(limit)
+		}
+	}
+	return marker + "\x00"
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+// listObjects handles both versions of the object listing. The continuation
+// tokens of the second version are the keys where the next listing starts.
+func (g *S3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+
+	maxKeys := s3MaxKeys
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, errInvalidArgument)
+			return
+		}
+
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		MaxKeys               int
+		IsTruncated           bool
+		Marker                string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              *int   `xml:",omitempty"`
+		Contents              []s3Object
+		CommonPrefixes        []s3Prefix
+	}{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+
+	root := s3Key(bucket, "")
+	start := ""
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+
+		switch {
+		case res.ContinuationToken != "":
+			next, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+			if err != nil {
+				writeS3Error(w, r, errInvalidArgument)
+				return
+			}
+			start = root + string(next)
+		case res.StartAfter != "":
+			start = listAfter(root+res.StartAfter, res.Delimiter)
+		}
+	} else if res.Marker = q.Get("marker"); res.Marker != "" {
+		start = listAfter(root+res.Marker, res.Delimiter)
+	}
+
+	list := ListResult{}
+	if maxKeys > 0 {
+		list = g.e.List(root+res.Prefix, start, res.Delimiter, maxKeys)
+	}
+
+	last := ""
+	for _, k := range list.Keys {
+		o := s3Object{
+			Key:          strings.TrimPrefix(k.Key, root),
+			ETag:         k.ETag,
+			Size:         k.Size,
+			StorageClass: "STANDARD",
+			LastModified: time.Unix(0, 0).UTC().Format(s3TimeFormat),
+		}
+
+		if k.Modified != nil {
+			o.LastModified = k.Modified.UTC().Format(s3TimeFormat)
+		}
+		res.Contents = append(res.Contents, o)
+
+		if o.Key > last {
+			last = o.Key
+		}
+	}
+
+	for _, p := range list.Prefixes {
+		prefix := strings.TrimPrefix(p, root)
+		res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{prefix})
+
+		if prefix > last {
+			last = prefix
+		}
+	}
+
+	res.IsTruncated = list.Next != ""
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(strings.TrimPrefix(list.Next, root)))
+		} else {
+			res.NextMarker = last
+		}
+	}
+
+	if v2 {
+		count := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &count
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
+
+// listBuckets lists the buckets that have objects.
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+
+	res := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+
+	// the creation time of a bucket is not known.
+	created := time.Unix(0, 0).UTC().Format(s3TimeFormat)
+	start := ""
+	for {
+		list := g.e.List("/", start, "/", maxListLimit)
+		for _, p := range list.Prefixes {
+			if name := strings.Trim(p, "/"); validBucket(name) {
+				res.Buckets = append(res.Buckets, bucket{name, created})
+			}
+		}
+
+		if list.Next == "" {
+			break
+		}
+		start = list.Next
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
+
+func (g *S3Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket, object string) {
+	nr := nativeRequest(r, r.Method, s3Key(bucket, object), http.NoBody, 0, "uploads")
+	nr.Header.Set(overwriteHeader, "true")
+
+	res := g.native(nr)
+	var u uploadRecord
+	if res.status != http.StatusOK || json.Unmarshal(res.body.Bytes(), &u) != nil {
+		(&s3Response{ResponseWriter: w, r: r}).WriteHeader(res.status)
+		return
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: object, UploadID: u.ID})
+}
+
+func (g *S3Gateway) listParts(w http.ResponseWriter, r *http.Request, bucket, object string) {
+	nr := nativeRequest(r, http.MethodGet, s3Key(bucket, object), http.NoBody, 0, "uploadId")
+
+	res := g.native(nr)
+	var u uploadRecord
+	if res.status != http.StatusOK || json.Unmarshal(res.body.Bytes(), &u) != nil {
+		(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchUpload"}).WriteHeader(res.status)
+		return
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int64
+	}
+
+	parts := make([]part, len(u.Parts))
+	for i, p := range u.Parts {
+		parts[i] = part{p.Number, `"` + p.ETag + `"`, p.Size}
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"ListPartsResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		Bucket       string
+		Key          string
+		UploadID     string `xml:"UploadId"`
+		StorageClass string
+		MaxParts     int
+		IsTruncated  bool
+		Parts        []part `xml:"Part"`
+	}{
+		Xmlns:        s3Namespace,
+		Bucket:       bucket,
+		Key:          object,
+		UploadID:     u.ID,
+		StorageClass: "STANDARD",
+		MaxParts:     maxPartNumber,
+		Parts:        parts,
+	})
+}
+
+// completeUpload completes a multipart upload. The etag of the object is
+// computed from the etags of the parts like in S3, see uploadETag.
+func (g *S3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, object string, body io.Reader) {
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+
+	if err := decodeXML(body, &req); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if len(req.Parts) == 0 {
+		writeS3Error(w, r, errMalformedXML)
+		return
+	}
+
+	parts := make([]uploadPart, len(req.Parts))
+	for i, p := range req.Parts {
+		parts[i] = uploadPart{Number: p.PartNumber, ETag: strings.Trim(p.ETag, `"`)}
+	}
+
+	b, err := json.Marshal(map[string][]uploadPart{"parts": parts})
+	if err != nil {
+		writeS3Error(w, r, errS3Internal)
+		return
+	}
+
+	key := s3Key(bucket, object)
+	nr := nativeRequest(r, r.Method, key, bytes.NewReader(b), int64(len(b)), "uploadId")
+	nr.Header.Set(overwriteHeader, "true")
+
+	res := g.native(nr)
+	if res.status != http.StatusCreated {
+		if res.status == http.StatusBadRequest {
+			writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidPart", "The parts don't match the uploaded parts"})
+			return
+		}
+		(&s3Response{ResponseWriter: w, r: r, notFound: "NoSuchUpload"}).WriteHeader(res.status)
+		return
+	}
+
+	for name, values := range res.header {
+		w.Header()[name] = values
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Namespace,
+		Location: key,
+		Bucket:   bucket,
+		Key:      object,
+		ETag:     res.header.Get("Etag"),
+	})
+}
@@ -0,0 +1,502 @@
+package engine
+
+// sigv4.go implements the signature version 4 authentication of the S3
+// gateway. Requests are signed either in the Authorization header or in the
+// query of a presigned url. The body is covered by the signature through its
+// sha256 digest, which is verified while the body is read. Bodies sent in the
+// aws-chunked encoding have a signature for every chunk instead.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+
+	// the payload hashes of bodies that are not signed as a whole.
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxClockSkew is how far the time of a signed request may be from the
+	// time of the gateway.
+	maxClockSkew = 15 * time.Minute
+
+	// maxPresignExpiry is the longest time a presigned url is valid.
+	maxPresignExpiry = 7 * 24 * time.Hour
+
+	// maxAWSChunkSize limits the size of a chunk in the aws-chunked encoding,
+	// since signed chunks are buffered until their signature is verified.
+	maxAWSChunkSize = 16 << 20
+)
+
+var (
+	errChunkSignature = fmt.Errorf("%w: invalid chunk signature", errChecksum)
+	errChunkEncoding  = errors.New("malformed aws-chunked body")
+)
+
+// sigV4 is the signature of a request.
+type sigV4 struct {
+	accessKey     string
+	amzDate       string
+	date          time.Time
+	scope         string
+	signedHeaders []string
+	signature     string
+	payload       string
+
+	// presigned urls are valid for expires after the time of the signature.
+	presigned bool
+	expires   time.Duration
+
+	// key is the signing key derived from the secret of the access key.
+	key []byte
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCredential parses the access key and the scope of a signature. The
+// scope is the date, region and service of the signature.
+func (sig *sigV4) parseCredential(credential string) error {
+	accessKey, scope, ok := strings.Cut(credential, "/")
+	parts := strings.Split(scope, "/")
+	if !ok || accessKey == "" || len(parts) != 4 || parts[2] != "s3" || parts[3] != "aws4_request" {
+		return errMalformedAuth
+	}
+
+	sig.accessKey = accessKey
+	sig.scope = scope
+	return nil
+}
+
+// parseDate parses the time of the signature, which also has to be the date
+// of its scope.
+func (sig *sigV4) parseDate(amzDate string) error {
+	date, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || !strings.HasPrefix(sig.scope, amzDate[:8]+"/") {
+		return errMalformedAuth
+	}
+
+	sig.amzDate = amzDate
+	sig.date = date
+	return nil
+}
+
+// parseAuthHeader parses a signature from the Authorization header, for
+// example:
+// AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request,
+// SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=abcd
+func parseAuthHeader(r *http.Request) (*sigV4, error) {
+	algorithm, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if algorithm != sigV4Algorithm {
+		return nil, errMalformedAuth
+	}
+
+	sig := &sigV4{payload: r.Header.Get("X-Amz-Content-Sha256")}
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "Credential":
+			if err := sig.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			sig.signature = value
+		}
+	}
+
+	if sig.scope == "" || sig.signature == "" || sig.payload == "" {
+		return nil, errMalformedAuth
+	}
+
+	if err := sig.parseDate(r.Header.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// parsePresigned parses a signature from the query of a presigned url.
+func parsePresigned(r *http.Request) (*sigV4, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errMalformedAuth
+	}
+
+	sig := &sigV4{
+		signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     q.Get("X-Amz-Signature"),
+		payload:       unsignedPayload,
+		presigned:     true,
+	}
+
+	if p := q.Get("X-Amz-Content-Sha256"); p != "" {
+		sig.payload = p
+	}
+
+	if err := sig.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+
+	if err := sig.parseDate(q.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+
+	secs, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxPresignExpiry {
+		return nil, errMalformedAuth
+	}
+	sig.expires = time.Duration(secs) * time.Second
+	return sig, nil
+}
+
+// awsEscape escapes s as in the canonical request. Everything but the
+// unreserved characters is escaped, slashes only if escapeSlash is set.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// headerValue returns the value of a signed header. Go moves some of the
+// headers out of the header map of the request.
+func headerValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	case "transfer-encoding":
+		values = r.TransferEncoding
+	default:
+		values = r.Header.Values(name)
+	}
+
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// canonicalRequest returns the canonical form of a request that is signed.
+func (sig *sigV4) canonicalRequest(r *http.Request) string {
+	type param struct{ name, value string }
+
+	params := make([]param, 0)
+	for name, values := range r.URL.Query() {
+		if sig.presigned && name == "X-Amz-Signature" {
+			continue
+		}
+
+		for _, v := range values {
+			params = append(params, param{awsEscape(name, true), awsEscape(v, true)})
+		}
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].name != params[j].name {
+			return params[i].name < params[j].name
+		}
+		return params[i].value < params[j].value
+	})
+
+	query := make([]string, len(params))
+	for i, p := range params {
+		query[i] = p.name + "=" + p.value
+	}
+
+	var headers strings.Builder
+	for _, name := range sig.signedHeaders {
+		headers.WriteString(name + ":" + headerValue(r, name) + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payload,
+	}, "\n")
+}
+
+// sign signs a string to sign of the given kind, the strings to sign of the
+// request itself and of its chunks and trailers differ only by the kind and
+// the digests.
+func (sig *sigV4) sign(kind string, digests ...string) string {
+	s := strings.Join(append([]string{kind, sig.amzDate, sig.scope}, digests...), "\n")
+	return hex.EncodeToString(hmacSHA256(sig.key, s))
+}
+
+// signingKey derives the signing key of a scope from a secret access key.
+func signingKey(secret, scope string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// authenticate verifies the signature of a request. It returns the body of
+// the request, which fails at its end if it doesn't match the signature, and
+// the length of the body.
+func (g *S3Gateway) authenticate(r *http.Request) (io.Reader, int64, error) {
+	var sig *sigV4
+	var err error
+	switch {
+	case r.Header.Get("Authorization") != "":
+		sig, err = parseAuthHeader(r)
+	case r.URL.Query().Has("X-Amz-Signature"):
+		sig, err = parsePresigned(r)
+	default:
+		return nil, 0, errAccessDenied
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	secret, ok := g.credentials[sig.accessKey]
+	if !ok {
+		return nil, 0, errInvalidAccessKey
+	}
+
+	now := time.Now()
+	if sig.presigned {
+		if now.After(sig.date.Add(sig.expires)) {
+			return nil, 0, errRequestExpired
+		}
+	} else if now.Sub(sig.date) > maxClockSkew || sig.date.Sub(now) > maxClockSkew {
+		return nil, 0, errTimeSkewed
+	}
+
+	sig.key = signingKey(secret, sig.scope)
+	expected := sig.sign(sigV4Algorithm, sha256Hex([]byte(sig.canonicalRequest(r))))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return nil, 0, errSignatureMismatch
+	}
+
+	switch sig.payload {
+	case unsignedPayload:
+		return r.Body, r.ContentLength, nil
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, 0, errMissingLength
+		}
+
+		cr := &awsChunkedReader{
+			br:      bufio.NewReader(r.Body),
+			size:    size,
+			trailer: sig.payload != streamingPayload,
+		}
+
+		if sig.payload != streamingUnsignedTrailer {
+			cr.sig = sig
+			cr.prev = sig.signature
+		}
+		return cr, size, nil
+	}
+
+	sum, err := hex.DecodeString(sig.payload)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, 0, errContentSHA256
+	}
+	return &payloadReader{r: r.Body, h: sha256.New(), sum: sum}, r.ContentLength, nil
+}
+
+// payloadReader verifies the sha256 digest of a signed body. Instead of
+// io.EOF, reading the end of the body returns errChecksum if the body doesn't
+// match.
+type payloadReader struct {
+	r   io.Reader
+	h   hash.Hash
+	sum []byte
+}
+
+func (pr *payloadReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.h.Write(p[:n])
+
+	if err == io.EOF && !bytes.Equal(pr.h.Sum(nil), pr.sum) {
+		return n, errChecksum
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes a body in the aws-chunked encoding. Every chunk is
+// prefixed by its size and signature, which chains the signature of the
+// previous chunk starting from the signature of the request:
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n
+//
+// The body ends with an empty chunk, which may be followed by trailing
+// headers and their signature. Unsigned bodies don't have the signatures.
+type awsChunkedReader struct {
+	br      *bufio.Reader
+	sig     *sigV4
+	prev    string
+	trailer bool
+
+	// size is the length of the decoded body and read is the amount of
+	// decoded bytes read.
+	size int64
+	read int64
+
+	buf []byte
+	off int
+	err error
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (int, error) {
+	for cr.off >= len(cr.buf) {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.next()
+	}
+
+	n := copy(p, cr.buf[cr.off:])
+	cr.off += n
+	return n, nil
+}
+
+// readLine reads a line without its line ending.
+func (cr *awsChunkedReader) readLine() (string, error) {
+	line, err := cr.br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line == "" {
+			return "", io.EOF
+		}
+		return "", errChunkEncoding
+	}
+	return strings.TrimSuffix(line[:len(line)-1], "\r"), nil
+}
+
+// next reads the next chunk into the buffer. It returns io.EOF after the
+// last chunk.
+func (cr *awsChunkedReader) next() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return errChunkEncoding
+	}
+
+	header, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(header), 16, 64)
+	if err != nil || size < 0 || size > maxAWSChunkSize || cr.read+size > cr.size {
+		return errChunkEncoding
+	}
+
+	if int64(cap(cr.buf)) < size {
+		cr.buf = make([]byte, size)
+	}
+	cr.buf, cr.off = cr.buf[:size], 0
+
+	if _, err := io.ReadFull(cr.br, cr.buf); err != nil {
+		return errChunkEncoding
+	}
+
+	if cr.sig != nil {
+		name, signature, _ := strings.Cut(ext, "=")
+		expected := cr.sig.sign(sigV4Algorithm+"-PAYLOAD", cr.prev, emptySHA256, sha256Hex(cr.buf))
+		if name != "chunk-signature" || !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errChunkSignature
+		}
+		cr.prev = signature
+	}
+
+	if size > 0 {
+		cr.read += size
+		if line, err := cr.readLine(); err != nil || line != "" {
+			return errChunkEncoding
+		}
+		return nil
+	}
+
+	if cr.read != cr.size {
+		return errChunkEncoding
+	}
+
+	if cr.trailer {
+		return cr.readTrailer()
+	}
+
+	// the final line ending is optional.
+	if _, err := cr.readLine(); err != nil && err != io.EOF {
+		return err
+	}
+	return io.EOF
+}
+
+// readTrailer reads and verifies the trailing headers after the last chunk.
+// The checksums in them are not verified, since the body is already covered
+// by the signatures or sent without them.
+func (cr *awsChunkedReader) readTrailer() error {
+	var trailer strings.Builder
+	signature := ""
+	for {
+		line, err := cr.readLine()
+		if err == io.EOF || line == "" {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		if name == "x-amz-trailer-signature" {
+			signature = value
+			continue
+		}
+		trailer.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	if cr.sig != nil {
+		expected := cr.sig.sign(sigV4Algorithm+"-TRAILER", cr.prev, sha256Hex([]byte(trailer.String())))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errChunkSignature
+		}
+	}
+	return io.EOF
+}
@@ -0,0 +1,65 @@
+package engine
+
+// stats.go contains counters of the work done by the engine. The counters are
+// exposed as json using GET /?stats.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+type counters struct {
+	readRepairs   atomic.Uint64
+	repairs       atomic.Uint64
+	repairsFailed atomic.Uint64
+	scrubbedKeys  atomic.Uint64
+	scrubErrors   atomic.Uint64
+	expired       atomic.Uint64
+	transitions   atomic.Uint64
+}
+
+// Stats is a snapshot of the engine's counters.
+type Stats struct {
+	// ReadRepairs is the amount of missing replicas noticed by reads.
+	ReadRepairs uint64 `json:"readRepairs"`
+
+	// Repairs is the amount of replicas that have been repaired.
+	Repairs uint64 `json:"repairs"`
+
+	// RepairsFailed is the amount of failed repair attempts.
+	RepairsFailed uint64 `json:"repairsFailed"`
+
+	// ScrubbedKeys is the amount of keys verified by the background scrubber.
+	ScrubbedKeys uint64 `json:"scrubbedKeys"`
+
+	// ScrubErrors is the amount of missing, corrupt, extra or unreachable
+	// replicas found by the background scrubber.
+	ScrubErrors uint64 `json:"scrubErrors"`
+
+	// Expired is the amount of expired keys deleted by the reaper.
+	Expired uint64 `json:"expired"`
+
+	// Transitions is the amount of values moved to another storage group by
+	// the lifecycle rules.
+	Transitions uint64 `json:"transitions"`
+}
+
+// Stats returns the current values of the engine's counters.
+func (e *Engine) Stats() Stats {
+	return Stats{
+		ReadRepairs:   e.counters.readRepairs.Load(),
+		Repairs:       e.counters.repairs.Load(),
+		RepairsFailed: e.counters.repairsFailed.Load(),
+		ScrubbedKeys:  e.counters.scrubbedKeys.Load(),
+		ScrubErrors:   e.counters.scrubErrors.Load(),
+		Expired:       e.counters.expired.Load(),
+		Transitions:   e.counters.transitions.Load(),
+	}
+}
+
+func (e *Engine) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(e.Stats())
+}
@@ -0,0 +1,243 @@
+package engine
+
+// stream.go implements streaming a single request body into multiple storage
+// servers at the same time. The body is never buffered as a whole, instead it
+// is written into a pipe for each of the storage servers, which means that the
+// write goes as fast as the slowest storage server consumes the data.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nireo/jakaja/volume"
+)
+
+// defaultStallTimeout is used when the engine doesn't define a stall timeout.
+const defaultStallTimeout = 30 * time.Second
+
+var (
+	errStalled = errors.New("storage server stalled")
+	errQuorum  = errors.New("not enough storage servers acknowledged the write")
+)
+
+// replicaWrite is a single write into a storage server.
+type replicaWrite struct {
+	storage string
+	path    string
+	pr      *io.PipeReader
+	pw      *io.PipeWriter
+	cancel  context.CancelFunc
+
+	// stall fails the write if it's not stopped within the stall timeout.
+	stall *time.Timer
+
+	// failed is set by the writer if writing into the pipe failed and err is
+	// set by the request goroutine once the request has finished. ok is set
+	// once the storage has acknowledged the write.
+	failed bool
+	err    error
+	ok     bool
+}
+
+func (rw *replicaWrite) abort(err error) {
+	rw.pw.CloseWithError(err)
+	rw.cancel()
+}
+
+// writeSet is a set of concurrent writes into storage servers. Writes that
+// fail or don't make progress within the timeout are dropped, and the whole
+// set fails once less than quorum writes are left.
+type writeSet struct {
+	writes  []*replicaWrite
+	timeout time.Duration
+	quorum  int
+	live    int
+	wg      sync.WaitGroup
+}
+
+// write writes p into a single write of the set.
+func (ws *writeSet) write(rw *replicaWrite, p []byte) {
+	if rw.failed {
+		return
+	}
+
+	rw.stall.Reset(ws.timeout)
+	_, err := rw.pw.Write(p)
+	rw.stall.Stop()
+
+	if err != nil {
+		log.Printf("dropping storage %s from write: %s\n", rw.storage, err)
+		rw.failed = true
+		ws.live--
+	}
+}
+
+// fanout is a writer that writes everything into each of the writes.
+type fanout struct {
+	*writeSet
+}
+
+func (f fanout) Write(p []byte) (int, error) {
+	for _, rw := range f.writes {
+		f.write(rw, p)
+	}
+
+	if f.live < f.quorum {
+		return 0, errQuorum
+	}
+	return len(p), nil
+}
+
+func (e *Engine) stallTimeout() time.Duration {
+	if e.StallTimeout > 0 {
+		return e.StallTimeout
+	}
+	return defaultStallTimeout
+}
+
+// startWrites starts writing a file of the given size into paths[i] on
+// storages[i]. If size is negative, the size is not known beforehand.
+func (e *Engine) startWrites(storages, paths []string, size int64, quorum int) *writeSet {
+	ws := &writeSet{
+		writes:  make([]*replicaWrite, len(storages)),
+		timeout: e.stallTimeout(),
+		quorum:  quorum,
+		live:    len(storages),
+	}
+
+	for i, storage := range storages {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rw := &replicaWrite{storage: storage, path: paths[i], cancel: cancel}
+		rw.pr, rw.pw = io.Pipe()
+		rw.stall = time.AfterFunc(ws.timeout, func() { rw.abort(errStalled) })
+		rw.stall.Stop()
+		ws.writes[i] = rw
+
+		ws.wg.Add(1)
+		go func() {
+			defer ws.wg.Done()
+			rw.err = e.volume(rw.storage).Put(ctx, rw.path, rw.pr, size)
+
+			// unblock the writer in case the request ended before the whole body
+			// was consumed.
+			rw.pr.CloseWithError(rw.err)
+		}()
+	}
+
+	return ws
+}
+
+// finishWrites ends the writes, or aborts them if err is set, and waits for
+// the storage servers to respond. The writes fail if less than quorum storages
+// acknowledged them, in which case the files are removed from every storage.
+// A storage may have committed the file although its write failed, for
+// example if it had received the whole body before the write was aborted.
+func (e *Engine) finishWrites(ws *writeSet, err error) error {
+	for _, rw := range ws.writes {
+		if err != nil {
+			rw.abort(err)
+		} else {
+			// the storage server still needs to respond in time.
+			rw.pw.Close()
+			rw.stall.Reset(ws.timeout)
+		}
+	}
+
+	ws.wg.Wait()
+
+	acked := 0
+	for _, rw := range ws.writes {
+		rw.stall.Stop()
+		rw.cancel()
+		if rw.err != nil {
+			log.Printf("error writing to storage %s: %s\n", rw.storage, rw.err)
+		} else if !rw.failed {
+			rw.ok = true
+			acked++
+		}
+	}
+
+	if err == nil && acked < ws.quorum {
+		err = errQuorum
+	}
+
+	if err != nil {
+		for _, rw := range ws.writes {
+			derr := e.volume(rw.storage).Delete(context.Background(), rw.path)
+			if derr != nil && !errors.Is(derr, volume.ErrNotFound) {
+				log.Printf("error cleaning up failed write: %s\n", derr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// copyBody copies a body of clen bytes into w. The storages commit a file of
+// known length once they have received every byte, while the checksums of the
+// body are only verified when reading its end. So the last byte is held back
+// until the end of the body has been read.
+func copyBody(w io.Writer, body io.Reader, clen int64) (int64, error) {
+	if clen <= 0 {
+		return io.Copy(w, body)
+	}
+
+	n, err := io.CopyN(w, body, clen-1)
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+
+	// reading past the last byte finds the end of the body, or the extra
+	// bytes of a body that is too long.
+	tail, err := io.ReadAll(io.LimitReader(body, 2))
+	if err != nil {
+		return n, err
+	}
+
+	if len(tail) > 1 {
+		return n + int64(len(tail)), nil
+	}
+
+	m, err := w.Write(tail)
+	return n + int64(m), err
+}
+
+// writeReplicas streams body into the given path on each of the storages. If
+// clen is not negative, the body has to be exactly clen bytes long. The write
+// succeeds if at least quorum storages have acknowledged it, in which case the
+// storages holding the value are returned. If the write fails, the value is
+// removed from every storage.
+func (e *Engine) writeReplicas(storages []string, path string, body io.Reader, clen int64, quorum int) ([]string, error) {
+	paths := make([]string, len(storages))
+	for i := range paths {
+		paths[i] = path
+	}
+	ws := e.startWrites(storages, paths, clen, quorum)
+
+	n, err := copyBody(fanout{ws}, body, clen)
+	if err == nil && clen >= 0 && n != clen {
+		err = fmt.Errorf("body length %d does not match content length %d", n, clen)
+	}
+
+	if err := e.finishWrites(ws, err); err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0, len(storages))
+	for _, rw := range ws.writes {
+		if rw.ok {
+			written = append(written, rw.storage)
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,222 @@
+package engine
+
+// trash.go implements the trash. When the engine has a trash retention,
+// deleting a key moves its value into the trash instead of removing it. The
+// files are copied under a trash path on the storages and the entry is kept as
+// soft deleted with the time of the deletion. The value can be moved back with
+// POST /$KEY?undelete, and the purge job removes the values that have been in
+// the trash for longer than the retention. With versioning, deletes create
+// delete markers instead, see version.go.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// trashPrefix is the key namespace of the trash index. The keys consist of the
+// deletion time and the object key, so the values that have been in the trash
+// the longest are at the start of the namespace.
+var trashPrefix = []byte("trash:")
+
+func trashKey(key []byte, deleted time.Time) []byte {
+	k := make([]byte, 0, len(trashPrefix)+17+len(key))
+	k = append(k, trashPrefix...)
+	k = append(k, fmt.Sprintf("%016x", deleted.UnixNano())...)
+	k = append(k, 0)
+	return append(k, key...)
+}
+
+// copyFile copies a file to another path on the same storage.
+func (e *Engine) copyFile(storage, from, to string) error {
+	ctx := context.Background()
+	vol := e.volume(storage)
+
+	size, err := vol.Head(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	r, err := vol.Get(ctx, from, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return vol.Put(ctx, to, r, size)
+}
+
+// moveEntry copies the files of old into the path of ent on every storage and
+// then switches the entry. The files of old are removed by the garbage
+// collector, so reads still using them don't fail. Storages missing the value
+// are left out of the new entry. If any other copy fails, nothing is changed.
+func (e *Engine) moveEntry(key []byte, old, ent entry.Entry) error {
+	if old.Chunked() {
+		return e.moveChunks(key, old, ent)
+	}
+
+	// the blob of a deduplicated value has the same path, so the value keeps
+	// its reference.
+	if old.Dedup {
+		return e.Put(key, ent)
+	}
+
+	// the shards of erasure coded values stay in the order of the storages,
+	// so missing shards leave a hole instead.
+	moved := make([]string, 0, len(old.Storages))
+	count := 0
+	for i, s := range old.Storages {
+		to := ent.FilePath(key, i)
+		err := volume.ErrNotFound
+		if s != "" {
+			err = e.copyFile(s, old.FilePath(key, i), to)
+		}
+
+		if errors.Is(err, volume.ErrNotFound) {
+			if old.Sharded() {
+				moved = append(moved, "")
+			}
+			continue
+		}
+
+		if err != nil {
+			for j, done := range moved {
+				if done != "" {
+					e.volume(done).Delete(context.Background(), ent.FilePath(key, j))
+				}
+			}
+			return err
+		}
+		moved = append(moved, s)
+		count++
+	}
+
+	if count == 0 || (old.Sharded() && count < old.DataShards) {
+		return volume.ErrNotFound
+	}
+
+	ent.Storages = moved
+	if err := e.switchEntry(key, old, ent); err != nil {
+		return err
+	}
+
+	if count < len(old.Storages) && ent.Status == entry.Exists {
+		e.queueRepair(key, missingStorages(moved, old.Storages))
+	}
+	return nil
+}
+
+// trash moves the value of key into the trash.
+func (e *Engine) trash(key []byte) int {
+	ent := e.Get(key)
+	if ent.Status != entry.Exists {
+		return http.StatusNotFound
+	}
+
+	// the files are moved into a new path, since the garbage collector may
+	// still remove files from the paths the key has used before.
+	trashed := ent
+	trashed.Status = entry.SoftDeleted
+	trashed.Version = e.pathID(key)
+	trashed.DeletedAt = time.Now().UTC()
+
+	// the trash index is written first, so the purge job always finds the
+	// value.
+	if err := e.DB.Put(trashKey(key, trashed.DeletedAt), nil, nil); err != nil {
+		return http.StatusInternalServerError
+	}
+
+	if err := e.moveEntry(key, ent, trashed); err != nil {
+		log.Printf("failed moving %s into the trash: %s\n", key, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusNoContent
+}
+
+// undelete moves the value of key out of the trash.
+func (e *Engine) undelete(key []byte) int {
+	ent := e.Get(key)
+	if !ent.Trashed() {
+		return http.StatusNotFound
+	}
+
+	restored := ent
+	restored.Status = entry.Exists
+	restored.Version = e.pathID(key)
+	restored.DeletedAt = time.Time{}
+
+	if err := e.moveEntry(key, ent, restored); err != nil {
+		log.Printf("failed moving %s out of the trash: %s\n", key, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusNoContent
+}
+
+// purge removes key if it's still in the trash since the given time.
+func (e *Engine) purge(key []byte, deleted time.Time) bool {
+	if err := e.LockKey(string(key)); err != nil {
+		// try again on the next round.
+		return false
+	}
+	defer e.RemoveLock(string(key))
+
+	ent := e.Get(key)
+	if !ent.Trashed() || !ent.DeletedAt.Equal(deleted) {
+		return true
+	}
+
+	if status := e.DeleteHandler(key); status != http.StatusNoContent {
+		log.Printf("purge: failed deleting %s: status %d\n", key, status)
+		return false
+	}
+	return true
+}
+
+// Purge removes the values that have been in the trash for longer than the
+// retention.
+func (e *Engine) Purge() {
+	if e.TrashRetention <= 0 {
+		return
+	}
+
+	limit := trashKey(nil, time.Now().Add(-e.TrashRetention))
+	it := e.DB.NewIterator(&util.Range{Start: trashPrefix, Limit: limit}, nil)
+	defer it.Release()
+
+	for it.Next() {
+		k := it.Key()[len(trashPrefix):]
+		sep := bytes.IndexByte(k, 0)
+		if sep < 0 {
+			continue
+		}
+
+		n, err := strconv.ParseUint(string(k[:sep]), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		key := make([]byte, len(k)-sep-1)
+		copy(key, k[sep+1:])
+		if e.purge(key, time.Unix(0, int64(n))) {
+			e.DB.Delete(it.Key(), nil)
+		}
+	}
+}
+
+// PurgeWorker empties the values whose retention has passed from the trash
+// every interval. Nothing is purged without a retention.
+func (e *Engine) PurgeWorker(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.Purge()
+	}
+}
@@ -0,0 +1,527 @@
+package engine
+
+// upload.go implements multipart uploads, which let clients upload a large
+// value in parts and retry the parts that failed instead of the whole value.
+//
+//   - POST /$KEY?uploads starts an upload and returns its id
+//   - PUT /$KEY?uploadId=$ID&partNumber=$N uploads a part, parts can be
+//     uploaded in parallel and uploading a part again replaces it
+//   - GET /$KEY?uploadId=$ID lists the uploaded parts
+//   - POST /$KEY?uploadId=$ID completes the upload
+//   - DELETE /$KEY?uploadId=$ID aborts the upload
+//
+// The parts are stored the same way as the chunks of a chunked value, so
+// completing an upload only writes the entry of the value without copying any
+// data, see chunk.go. The value is stored under the upload id as its version.
+// Since the value is never read while it's stored, its checksum is not known
+// when the upload is completed. Each part is checked against its md5 checksum
+// when it's uploaded, but the value itself is not verified: the first
+// verification stores the checksum of the value as it is on the storages.
+// The uploads are tracked in their own key namespace of the index and uploads
+// that are never completed are aborted by a reaper.
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	maxPartNumber = 10000
+
+	// uploadLockWait is how long updating an upload waits for the other
+	// updates of the same upload.
+	uploadLockWait = 10 * time.Second
+)
+
+// uploadPrefix is the key namespace of the multipart uploads.
+var uploadPrefix = []byte("upload:")
+
+func uploadKey(key []byte, id string) []byte {
+	k := make([]byte, 0, len(uploadPrefix)+len(key)+len(id)+1)
+	k = append(k, uploadPrefix...)
+	k = append(k, key...)
+	k = append(k, 0)
+	return append(k, id...)
+}
+
+// uploadPart is an uploaded part of a multipart upload. Every upload of a
+// part is written into its own file, named by the id of the upload, so that
+// uploading a part again never touches the files of the part it replaces.
+type uploadPart struct {
+	Number   int      `json:"partNumber"`
+	ETag     string   `json:"etag"`
+	Size     int64    `json:"size,omitempty"`
+	Storages []string `json:"storages,omitempty"`
+	ID       string   `json:"id,omitempty"`
+}
+
+// chunk returns the part as a chunk of the completed value.
+func (p *uploadPart) chunk() entry.Chunk {
+	return entry.Chunk{Storages: p.Storages, Size: p.Size, ID: p.ID}
+}
+
+// newPartID returns a random id for an upload of a part.
+func newPartID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// uploadRecord is a multipart upload in progress. The options of the write are
+// given when the upload is started.
+type uploadRecord struct {
+	Key         string            `json:"key"`
+	ID          string            `json:"uploadId"`
+	Created     time.Time         `json:"created"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Expires     time.Time         `json:"expires"`
+	Parts       []uploadPart      `json:"parts"`
+}
+
+// partPath returns the path of a part on the storages. It's the path of the
+// matching chunk of the completed value.
+func (u *uploadRecord) partPath(p uploadPart) string {
+	ent := entry.Entry{Version: u.ID}
+	c := p.chunk()
+	return c.Path(ent.Path([]byte(u.Key)), p.Number-1)
+}
+
+func (e *Engine) putUpload(u *uploadRecord) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return e.DB.Put(uploadKey([]byte(u.Key), u.ID), b, nil)
+}
+
+func (e *Engine) getUpload(key []byte, id string) (*uploadRecord, error) {
+	b, err := e.DB.Get(uploadKey(key, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var u uploadRecord
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// lockUpload locks an upload for updating it. Parts of the same upload may
+// be uploaded at the same time, so it waits for the other updates.
+func (e *Engine) lockUpload(key []byte, id string) (func(), error) {
+	lock := string(uploadKey(key, id))
+	if err := e.lockKeyWait(lock, uploadLockWait); err != nil {
+		return nil, err
+	}
+	return func() { e.RemoveLock(lock) }, nil
+}
+
+// removeParts removes the files of parts from their storages.
+func (e *Engine) removeParts(u *uploadRecord, parts []uploadPart) {
+	for _, p := range parts {
+		for _, s := range p.Storages {
+			if err := e.volume(s).Delete(context.Background(), u.partPath(p)); err != nil {
+				log.Printf("uploads: failed deleting part %d of %s: %s\n", p.Number, u.Key, err)
+			}
+		}
+	}
+}
+
+// serveUpload handles the requests of multipart uploads. The requests don't
+// lock the key, so that the parts can be uploaded in parallel.
+func (e *Engine) serveUpload(w http.ResponseWriter, r *http.Request, key []byte) {
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		e.createUpload(w, r, key)
+	case id == "":
+		w.WriteHeader(http.StatusBadRequest)
+	case r.Method == http.MethodPut:
+		e.putPart(w, r, key, id)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		e.serveParts(w, key, id)
+	case r.Method == http.MethodPost:
+		e.completeUpload(w, r, key, id)
+	case r.Method == http.MethodDelete:
+		e.abortUpload(w, key, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (e *Engine) createUpload(w http.ResponseWriter, r *http.Request, key []byte) {
+	if !e.canReplace(r, e.Get(key)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	meta := parseMeta(r.Header)
+	if !validMeta(meta) {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	expires, valid := parseExpiry(r)
+	if !valid {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u := &uploadRecord{
+		Key:         string(key),
+		ID:          e.pathID(key),
+		Created:     time.Now().UTC(),
+		ContentType: r.Header.Get("Content-Type"),
+		Meta:        meta,
+		Expires:     expires,
+		Parts:       []uploadPart{},
+	}
+
+	if err := e.putUpload(u); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(u)
+}
+
+func (e *Engine) putPart(w http.ResponseWriter, r *http.Request, key []byte, id string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := e.getUpload(key, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var opts PutOptions
+	if !parseChecksums(r, &opts) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	partID, err := newPartID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	part := uploadPart{Number: n, ID: partID}
+
+	// the etag of a part is its md5 checksum.
+	body := newChecksumReader(r.Body, entry.MD5, opts)
+	storages := e.chunkStorages(key, entry.Entry{}, n-1)
+	written, err := e.writeReplicas(storages, u.partPath(part), body, r.ContentLength, e.writeQuorum())
+	if err != nil {
+		log.Printf("uploads: error writing part %d of %s: %s\n", n, key, err)
+		if errors.Is(err, errChecksum) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	part.ETag, part.Size, part.Storages = body.hash(), body.size, written
+
+	unlock, err := e.lockUpload(key, id)
+	if err != nil {
+		e.removeParts(u, []uploadPart{part})
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	// the upload may have been completed or aborted during the write.
+	if u, err = e.getUpload(key, id); err != nil {
+		e.removeParts(&uploadRecord{Key: string(key), ID: id}, []uploadPart{part})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	replaced := make([]uploadPart, 0, 1)
+	i := sort.Search(len(u.Parts), func(i int) bool { return u.Parts[i].Number >= n })
+	if i < len(u.Parts) && u.Parts[i].Number == n {
+		replaced = append(replaced, u.Parts[i])
+		u.Parts[i] = part
+	} else {
+		u.Parts = append(u.Parts, uploadPart{})
+		copy(u.Parts[i+1:], u.Parts[i:])
+		u.Parts[i] = part
+	}
+
+	if err := e.putUpload(u); err != nil {
+		e.removeParts(u, []uploadPart{part})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the files of the replaced part are only removed once the record no
+	// longer refers to them.
+	e.removeParts(u, replaced)
+
+	w.Header().Set("Etag", `"`+part.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) serveParts(w http.ResponseWriter, key []byte, id string) {
+	u, err := e.getUpload(key, id)
+	if err != nil {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(u)
+}
+
+// completedParts returns the parts of the completed value. The client can list
+// the parts and their etags, in which case the parts not listed are dropped.
+// Otherwise every uploaded part is used. Either way, the parts have to be
+// numbered from one without gaps, since they are the chunks of the value.
+func completedParts(u *uploadRecord, body io.Reader) ([]uploadPart, bool) {
+	var req struct {
+		Parts []uploadPart `json:"parts"`
+	}
+
+	if err := json.NewDecoder(body).Decode(&req); err != nil && err != io.EOF {
+		return nil, false
+	}
+
+	if req.Parts == nil {
+		req.Parts = u.Parts
+	}
+
+	if len(req.Parts) == 0 || len(req.Parts) > len(u.Parts) {
+		return nil, false
+	}
+
+	parts := make([]uploadPart, len(req.Parts))
+	for i, p := range req.Parts {
+		etag := strings.Trim(p.ETag, `"`)
+		if p.Number != i+1 || u.Parts[i].Number != i+1 || (etag != "" && etag != u.Parts[i].ETag) {
+			return nil, false
+		}
+		parts[i] = u.Parts[i]
+	}
+	return parts, true
+}
+
+// uploadETag returns the etag of a value completed from parts. Like in S3, it
+// is the md5 checksum of the md5 checksums of the parts followed by the
+// amount of parts, so that clients can compute it from the parts.
+func uploadETag(parts []uploadPart) string {
+	h := md5.New()
+	for _, p := range parts {
+		sum, _ := hex.DecodeString(p.ETag)
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(parts))
+}
+
+func (e *Engine) completeUpload(w http.ResponseWriter, r *http.Request, key []byte, id string) {
+	if err := e.LockKey(string(key)); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer e.RemoveLock(string(key))
+
+	unlock, err := e.lockUpload(key, id)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	u, err := e.getUpload(key, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	parts, ok := completedParts(u, r.Body)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	current := e.Get(key)
+	if !e.canReplace(r, current) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// the upload id is the version of the value, so with versioning it cannot
+	// be older than the latest version.
+	if e.Versioning {
+		latest := e.latestVersion(key)
+		if (latest != nil && latest.ID >= u.ID) || current.Version >= u.ID {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+
+	// the checksum of the value is not known, so it's filled in by the
+	// verification like for values found when rebuilding the index. The etag
+	// is computed from the parts instead.
+	ent := entry.Entry{
+		Storages:    []string{},
+		Status:      entry.Exists,
+		ETag:        uploadETag(parts),
+		Version:     u.ID,
+		ContentType: u.ContentType,
+		Meta:        u.Meta,
+		Expires:     u.Expires,
+		Modified:    time.Now().UTC(),
+		Chunks:      make([]entry.Chunk, len(parts)),
+	}
+
+	for i, p := range parts {
+		ent.Chunks[i] = p.chunk()
+		ent.Size += p.Size
+	}
+
+	if status := e.commitEntry(key, current, ent); status != http.StatusCreated {
+		w.WriteHeader(status)
+		return
+	}
+
+	if err := e.DB.Delete(uploadKey(key, id), nil); err != nil {
+		log.Printf("uploads: failed removing completed upload %s of %s: %s\n", id, key, err)
+	}
+	e.removeParts(u, u.Parts[len(parts):])
+
+	// the parts that were not written to every storage are repaired like
+	// chunks.
+	missing := make([]string, 0)
+	for i, c := range ent.Chunks {
+		for _, s := range missingStorages(c.Storages, e.chunkStorages(key, ent, i)) {
+			if len(missingStorages(missing, []string{s})) > 0 {
+				missing = append(missing, s)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		e.queueRepair(key, missing)
+	}
+
+	if e.Versioning {
+		w.Header().Set(versionHeader, ent.Version)
+	}
+	w.Header().Set("Etag", etag(ent))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// abort removes an upload and its parts. The caller must hold the lock of the
+// upload.
+func (e *Engine) abort(u *uploadRecord) error {
+	e.removeParts(u, u.Parts)
+	return e.DB.Delete(uploadKey([]byte(u.Key), u.ID), nil)
+}
+
+func (e *Engine) abortUpload(w http.ResponseWriter, key []byte, id string) {
+	unlock, err := e.lockUpload(key, id)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	u, err := e.getUpload(key, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := e.abort(u); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReapUploads aborts the uploads that were started longer than the upload
+// expiry ago.
+func (e *Engine) ReapUploads() {
+	if e.UploadExpiry <= 0 {
+		return
+	}
+
+	limit := time.Now().Add(-e.UploadExpiry)
+	stale := make([]*uploadRecord, 0)
+
+	it := e.DB.NewIterator(util.BytesPrefix(uploadPrefix), nil)
+	for it.Next() {
+		var u uploadRecord
+		if err := json.Unmarshal(it.Value(), &u); err != nil {
+			log.Printf("uploads: invalid upload: %s\n", err)
+			continue
+		}
+
+		if u.Created.Before(limit) {
+			stale = append(stale, &u)
+		}
+	}
+	it.Release()
+
+	for _, u := range stale {
+		lock := string(uploadKey([]byte(u.Key), u.ID))
+		if err := e.LockKey(lock); err != nil {
+			// try again on the next round.
+			continue
+		}
+
+		// the upload may have been completed or its parts replaced in the
+		// meantime.
+		if u, err := e.getUpload([]byte(u.Key), u.ID); err == nil {
+			if err := e.abort(u); err != nil {
+				log.Printf("uploads: failed aborting upload %s of %s: %s\n", u.ID, u.Key, err)
+			}
+		}
+		e.RemoveLock(lock)
+	}
+}
+
+// UploadReapWorker aborts the stale uploads every interval. Uploads are only
+// aborted once they are older than the upload expiry, so the interval only
+// bounds how long their parts stay on the storages after that.
+func (e *Engine) UploadReapWorker(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.ReapUploads()
+	}
+}
+
+// uploadRequest reports whether r belongs to a multipart upload.
+func uploadRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("uploadId") || (r.Method == http.MethodPost && q.Has("uploads"))
+}
@@ -0,0 +1,516 @@
+package engine
+
+// verify.go implements verifying the stored values against the checksums in
+// the index. Every replica of every key is read and hashed, and replicas that
+// are missing or don't match the checksum are reported. Optionally the bad
+// replicas are repaired by copying the value from a replica that matches the
+// checksum. Verification can be run once with --action=verify or continuously
+// in the background with a rate limit.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
+)
+
+// verifyLockWait is how long storing the results of a verification waits for
+// a write or a repair of the same key to finish.
+const verifyLockWait = 10 * time.Second
+
+// VerifyOptions control how the verification is done.
+type VerifyOptions struct {
+	// Workers is the amount of keys verified concurrently.
+	Workers int
+
+	// Rate limits the amount of bytes read per second. Zero means no limit.
+	Rate int64
+
+	// Repair replaces missing and corrupt replicas with a good replica.
+	Repair bool
+}
+
+// VerifyReport contains the results of a verification.
+type VerifyReport struct {
+	// Keys is the amount of keys verified.
+	Keys int
+
+	// Missing is the amount of replicas in the index that don't exist.
+	Missing int
+
+	// Corrupt is the amount of replicas not matching the checksum.
+	Corrupt int
+
+	// Extra is the amount of copies on storages that are not in the index.
+	Extra int
+
+	// Unreachable is the amount of replicas that could not be read.
+	Unreachable int
+
+	// Repaired is the amount of missing or corrupt replicas that were
+	// repaired.
+	Repaired int
+}
+
+// OK reports whether the verification found no problems.
+func (r VerifyReport) OK() bool {
+	return r.Missing == 0 && r.Corrupt == 0 && r.Extra == 0 && r.Unreachable == 0
+}
+
+// rateLimiter limits the amount of bytes read per second. It's shared between
+// all of the readers.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l.rate <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limiter.wait(n)
+	return n, err
+}
+
+// hashReplica reads the value at path from storage and returns its checksum.
+func (e *Engine) hashReplica(storage, path string, algo entry.HashAlgo, limiter *rateLimiter) (string, error) {
+	rc, err := e.volume(storage).Get(context.Background(), path, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	hasher := algo.New()
+	if _, err := io.Copy(hasher, &limitedReader{rc, limiter}); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+type verifier struct {
+	e       *Engine
+	opts    VerifyOptions
+	limiter *rateLimiter
+
+	mu     sync.Mutex
+	report VerifyReport
+}
+
+func (v *verifier) add(f func(r *VerifyReport)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f(&v.report)
+}
+
+// locked calls f holding the lock of key, if the value of key is still the
+// one in ent. The values are read without the lock, so that writes aren't
+// blocked while a large value is verified, and the results are only applied
+// if the key wasn't written meanwhile.
+func (v *verifier) locked(key []byte, ent entry.Entry, f func()) {
+	e := v.e
+	if err := e.lockKeyWait(string(key), verifyLockWait); err != nil {
+		log.Printf("verify: skipping locked key %s\n", key)
+		return
+	}
+	defer e.RemoveLock(string(key))
+
+	cur := e.Get(key)
+	if cur.Status != entry.Exists || cur.Hash != ent.Hash || cur.Version != ent.Version ||
+		!reflect.DeepEqual(cur.Storages, ent.Storages) || !reflect.DeepEqual(cur.Chunks, ent.Chunks) {
+		log.Printf("verify: %s changed while it was verified\n", key)
+		return
+	}
+	f()
+}
+
+func (v *verifier) verify(key []byte) {
+	e := v.e
+	ent := e.Get(key)
+	if ent.Status != entry.Exists {
+		return
+	}
+
+	if ent.Sharded() {
+		v.verifyShards(key, ent)
+		return
+	}
+
+	if ent.Chunked() {
+		v.verifyChunks(key, ent)
+		return
+	}
+	path := ent.Path(key)
+	orig := ent
+
+	// missing checksums are computed with the configured algorithm.
+	if ent.Hash == "" {
+		ent.HashAlgo = e.HashAlgo
+	}
+
+	hashes := make(map[string]string, len(ent.Storages))
+	bad := make([]string, 0)
+	for _, s := range ent.Storages {
+		hash, err := e.hashReplica(s, path, ent.HashAlgo, v.limiter)
+		if errors.Is(err, volume.ErrNotFound) {
+			log.Printf("verify: %s is missing from %s\n", key, s)
+			v.add(func(r *VerifyReport) { r.Missing++ })
+			bad = append(bad, s)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("verify: cannot read %s from %s: %s\n", key, s, err)
+			v.add(func(r *VerifyReport) { r.Unreachable++ })
+			continue
+		}
+		hashes[s] = hash
+	}
+
+	// entries rebuilt from the storages don't have a checksum. If every replica
+	// agrees, the checksum can be filled in.
+	if ent.Hash == "" {
+		for _, hash := range hashes {
+			if ent.Hash == "" {
+				ent.Hash = hash
+			} else if ent.Hash != hash {
+				log.Printf("verify: replicas of %s without checksum disagree\n", key)
+				v.add(func(r *VerifyReport) { r.Corrupt++ })
+				ent.Hash = ""
+				break
+			}
+		}
+
+		if ent.Hash != "" && len(bad) == 0 && len(hashes) == len(ent.Storages) {
+			v.locked(key, orig, func() {
+				if err := e.Put(key, ent); err != nil {
+					log.Printf("verify: failed to store checksum of %s: %s\n", key, err)
+				}
+			})
+		}
+	}
+
+	good := make([]string, 0, len(hashes))
+	for _, s := range ent.Storages {
+		hash, ok := hashes[s]
+		if !ok {
+			continue
+		}
+
+		if ent.Hash != "" && hash != ent.Hash {
+			log.Printf("verify: %s on %s does not match the checksum\n", key, s)
+			v.add(func(r *VerifyReport) { r.Corrupt++ })
+			bad = append(bad, s)
+			continue
+		}
+		good = append(good, s)
+	}
+
+	// copies on the storages where the key belongs, but which are not in the
+	// entry.
+	keyStorages := e.keyStorages(key, ent)
+	for _, s := range missingStorages(ent.Storages, keyStorages) {
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(s).Head(ctx, path)
+		cancel()
+
+		if err == nil {
+			log.Printf("verify: extra copy of %s on %s\n", key, s)
+			v.add(func(r *VerifyReport) { r.Extra++ })
+		}
+	}
+
+	if !v.opts.Repair || ent.Hash == "" || len(good) == 0 {
+		return
+	}
+
+	v.locked(key, ent, func() {
+		for _, s := range bad {
+			var err error
+			for _, from := range good {
+				if err = e.copyValue(from, s, path); err == nil {
+					break
+				}
+			}
+
+			if err != nil {
+				log.Printf("verify: failed repairing %s on %s: %s\n", key, s, err)
+				e.counters.repairsFailed.Add(1)
+				continue
+			}
+
+			v.add(func(r *VerifyReport) { r.Repaired++ })
+			e.counters.repairs.Add(1)
+		}
+	})
+}
+
+// verifyShards verifies the shards of an erasure coded value. The shards don't
+// have checksums of their own, so the value is decoded and checked against
+// the checksum of the value.
+func (v *verifier) verifyShards(key []byte, ent entry.Entry) {
+	e := v.e
+	keyStorages := e.keyStorages(key, ent)
+	orig := ent
+
+	bad := make([]string, 0)
+	for i, s := range ent.Storages {
+		if s == "" {
+			log.Printf("verify: shard %d of %s is missing\n", i, key)
+			v.add(func(r *VerifyReport) { r.Missing++ })
+			if i < len(keyStorages) {
+				bad = append(bad, keyStorages[i])
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(s).Head(ctx, ent.FilePath(key, i))
+		cancel()
+
+		if errors.Is(err, volume.ErrNotFound) {
+			log.Printf("verify: shard %d of %s is missing from %s\n", i, key, s)
+			v.add(func(r *VerifyReport) { r.Missing++ })
+			bad = append(bad, s)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("verify: cannot read shard %d of %s from %s: %s\n", i, key, s, err)
+			v.add(func(r *VerifyReport) { r.Unreachable++ })
+		}
+	}
+
+	if ent.Hash == "" {
+		ent.HashAlgo = e.HashAlgo
+	}
+
+	sr, err := e.openShards(context.Background(), key, ent)
+	if err != nil {
+		log.Printf("verify: cannot decode %s: %s\n", key, err)
+		v.add(func(r *VerifyReport) { r.Unreachable++ })
+		return
+	}
+	sr.limiter = v.limiter
+
+	hasher := ent.HashAlgo.New()
+	_, err = io.Copy(hasher, sr)
+	sr.Close()
+	if err != nil {
+		log.Printf("verify: cannot decode %s: %s\n", key, err)
+		v.add(func(r *VerifyReport) { r.Unreachable++ })
+		return
+	}
+
+	hash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if ent.Hash == "" {
+		ent.Hash = hash
+		v.locked(key, orig, func() {
+			if err := e.Put(key, ent); err != nil {
+				log.Printf("verify: failed to store checksum of %s: %s\n", key, err)
+			}
+		})
+	} else if hash != ent.Hash {
+		log.Printf("verify: %s does not match the checksum\n", key)
+		v.add(func(r *VerifyReport) { r.Corrupt++ })
+		return
+	}
+
+	// shards on the storages where the key belongs, but which are not in the
+	// entry.
+	for i, s := range keyStorages {
+		if i < len(ent.Storages) && ent.Storages[i] == s {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+		_, err := e.volume(s).Head(ctx, ent.FilePath(key, i))
+		cancel()
+
+		if err == nil {
+			log.Printf("verify: extra shard %d of %s on %s\n", i, key, s)
+			v.add(func(r *VerifyReport) { r.Extra++ })
+		}
+	}
+
+	if !v.opts.Repair {
+		return
+	}
+
+	v.locked(key, ent, func() {
+		for _, s := range bad {
+			if e.repairShard(key, ent, s) {
+				v.add(func(r *VerifyReport) { r.Repaired++ })
+			}
+		}
+	})
+}
+
+// verifyChunks verifies the chunks of a chunked value. The chunks don't have
+// checksums of their own, so the whole value is read and checked against the
+// checksum of the value.
+func (v *verifier) verifyChunks(key []byte, ent entry.Entry) {
+	e := v.e
+	path := ent.Path(key)
+	orig := ent
+
+	// the amount of missing chunks on each storage.
+	bad := make(map[string]int)
+	for i, c := range ent.Chunks {
+		chunkPath := c.Path(path, i)
+		for _, s := range c.Storages {
+			ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+			_, err := e.volume(s).Head(ctx, chunkPath)
+			cancel()
+
+			if errors.Is(err, volume.ErrNotFound) {
+				log.Printf("verify: chunk %d of %s is missing from %s\n", i, key, s)
+				v.add(func(r *VerifyReport) { r.Missing++ })
+				bad[s]++
+				continue
+			}
+
+			if err != nil {
+				log.Printf("verify: cannot read chunk %d of %s from %s: %s\n", i, key, s, err)
+				v.add(func(r *VerifyReport) { r.Unreachable++ })
+			}
+		}
+
+		// copies on the storages where the chunk belongs, but which are not
+		// in the entry.
+		for _, s := range missingStorages(c.Storages, e.chunkStorages(key, ent, i)) {
+			ctx, cancel := context.WithTimeout(context.Background(), headTimeout)
+			_, err := e.volume(s).Head(ctx, chunkPath)
+			cancel()
+
+			if err == nil {
+				log.Printf("verify: extra copy of chunk %d of %s on %s\n", i, key, s)
+				v.add(func(r *VerifyReport) { r.Extra++ })
+			}
+		}
+	}
+
+	if ent.Hash == "" {
+		ent.HashAlgo = e.HashAlgo
+	}
+
+	cr := e.openChunks(context.Background(), key, ent)
+	hasher := ent.HashAlgo.New()
+	_, err := io.Copy(hasher, &limitedReader{cr, v.limiter})
+	cr.Close()
+	if err != nil {
+		log.Printf("verify: cannot read %s: %s\n", key, err)
+		v.add(func(r *VerifyReport) { r.Unreachable++ })
+		return
+	}
+
+	hash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if ent.Hash == "" {
+		ent.Hash = hash
+		v.locked(key, orig, func() {
+			if err := e.Put(key, ent); err != nil {
+				log.Printf("verify: failed to store checksum of %s: %s\n", key, err)
+			}
+		})
+	} else if hash != ent.Hash {
+		log.Printf("verify: %s does not match the checksum\n", key)
+		v.add(func(r *VerifyReport) { r.Corrupt++ })
+		return
+	}
+
+	if !v.opts.Repair {
+		return
+	}
+
+	v.locked(key, ent, func() {
+		for s, n := range bad {
+			if e.repairChunks(key, ent, s) {
+				v.add(func(r *VerifyReport) { r.Repaired += n })
+			}
+		}
+	})
+}
+
+// Verify goes through every key in the index and verifies its replicas
+// against the stored checksum.
+func (e *Engine) Verify(opts VerifyOptions) VerifyReport {
+	v := &verifier{
+		e:       e,
+		opts:    opts,
+		limiter: &rateLimiter{rate: opts.Rate},
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	requests := make(chan []byte, 20000)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range requests {
+				v.verify(key)
+				v.add(func(r *VerifyReport) { r.Keys++ })
+			}
+		}()
+	}
+
+	it := e.DB.NewIterator(objectRange, nil)
+	for it.Next() {
+		key := make([]byte, len(it.Key()))
+		copy(key, it.Key())
+		requests <- key
+	}
+	it.Release()
+
+	close(requests)
+	wg.Wait()
+
+	return v.report
+}
+
+// ScrubWorker verifies the whole index with the given options, waiting for
+// interval before each pass, and adds the results to the scrub counters.
+func (e *Engine) ScrubWorker(interval time.Duration, opts VerifyOptions) {
+	for {
+		time.Sleep(interval)
+
+		start := time.Now()
+		report := e.Verify(opts)
+		e.counters.scrubbedKeys.Add(uint64(report.Keys))
+		e.counters.scrubErrors.Add(uint64(report.Missing + report.Corrupt + report.Extra + report.Unreachable))
+
+		log.Printf("scrub: verified %d keys in %s: %+v\n", report.Keys, time.Since(start), report)
+	}
+}
@@ -0,0 +1,389 @@
+package engine
+
+// version.go implements object versioning. When versioning is enabled, every
+// write of a key creates a new immutable version that is stored in its own
+// file on the storages. The index entry of the key points to the latest
+// version, and every version is also recorded under its own key namespace in
+// the index. Deleting a key creates a delete marker which hides the key until
+// the marker itself is deleted. The endpoints are:
+// - GET /$KEY?versions: List the versions of a key, newest first
+// - GET /$KEY?versionId=$ID: Read a specific version
+// - DELETE /$KEY?versionId=$ID: Permanently delete a version or a delete marker
+// - POST /$KEY?restore&versionId=$ID: Write an old version as the latest one
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nireo/jakaja/entry"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	versionHeader      = "X-Jakaja-Version-Id"
+	deleteMarkerHeader = "X-Jakaja-Delete-Marker"
+
+	// nullVersion is the version id of values written without versioning.
+	nullVersion = "null"
+)
+
+// versionPrefix is the key namespace of the version records.
+var versionPrefix = []byte("ver:")
+
+// versionRecord is a single version of a key.
+type versionRecord struct {
+	ID           string            `json:"id"`
+	Storages     []string          `json:"storages,omitempty"`
+	Hash         string            `json:"hash,omitempty"`
+	HashAlgo     entry.HashAlgo    `json:"hashAlgo,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	DeleteMarker bool              `json:"deleteMarker,omitempty"`
+	Created      time.Time         `json:"created"`
+	Group        string            `json:"group,omitempty"`
+	DataShards   int               `json:"dataShards,omitempty"`
+	ParityShards int               `json:"parityShards,omitempty"`
+	BlockSize    int               `json:"blockSize,omitempty"`
+	Chunks       []entry.Chunk     `json:"chunks,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	Dedup        bool              `json:"dedup,omitempty"`
+}
+
+func (v *versionRecord) entry() entry.Entry {
+	return entry.Entry{
+		Storages:    v.Storages,
+		Status:      entry.Exists,
+		Hash:        v.Hash,
+		HashAlgo:    v.HashAlgo,
+		Version:     v.ID,
+		Size:        v.Size,
+		ContentType: v.ContentType,
+		Modified:    v.Created,
+		Meta:        v.Meta,
+		Group:       v.Group,
+
+		DataShards:   v.DataShards,
+		ParityShards: v.ParityShards,
+		BlockSize:    v.BlockSize,
+		Chunks:       v.Chunks,
+		ETag:         v.ETag,
+		Dedup:        v.Dedup,
+	}
+}
+
+// set updates the record from the entry of the version.
+func (v *versionRecord) set(ent entry.Entry) {
+	v.Storages = ent.Storages
+	v.Hash = ent.Hash
+	v.HashAlgo = ent.HashAlgo
+	v.Size = ent.Size
+	v.ContentType = ent.ContentType
+	v.Meta = ent.Meta
+	v.Group = ent.Group
+	v.DataShards = ent.DataShards
+	v.ParityShards = ent.ParityShards
+	v.BlockSize = ent.BlockSize
+	v.Chunks = ent.Chunks
+	v.ETag = ent.ETag
+	v.Dedup = ent.Dedup
+	if !ent.Modified.IsZero() {
+		v.Created = ent.Modified
+	}
+}
+
+// Version describes a single version of a key in the version listing.
+type Version struct {
+	VersionID    string    `json:"versionId"`
+	Hash         string    `json:"hash,omitempty"`
+	HashAlgo     string    `json:"hashAlgo,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	DeleteMarker bool      `json:"deleteMarker,omitempty"`
+	Created      time.Time `json:"created"`
+	Latest       bool      `json:"latest"`
+}
+
+// versionID converts a version id into its api form.
+func versionID(id string) string {
+	if id == "" {
+		return nullVersion
+	}
+	return id
+}
+
+// versionTime returns the creation time encoded in a version id. Version ids
+// are the creation time in nanoseconds as hex. The ids of temporary paths have
+// the time as well.
+func versionTime(id string) time.Time {
+	n, err := strconv.ParseUint(strings.TrimPrefix(id, pathPrefix), 16, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+func versionKey(key []byte, id string) []byte {
+	k := make([]byte, 0, len(versionPrefix)+len(key)+len(id)+1)
+	k = append(k, versionPrefix...)
+	k = append(k, key...)
+	k = append(k, 0)
+	return append(k, id...)
+}
+
+func (e *Engine) putVersion(key []byte, v *versionRecord) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.DB.Put(versionKey(key, v.ID), b, nil)
+}
+
+func (e *Engine) getVersion(key []byte, id string) (*versionRecord, error) {
+	b, err := e.DB.Get(versionKey(key, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var v versionRecord
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// versionRecords returns the recorded versions of key, oldest first.
+func (e *Engine) versionRecords(key []byte) []*versionRecord {
+	records := make([]*versionRecord, 0)
+
+	it := e.DB.NewIterator(util.BytesPrefix(versionKey(key, "")), nil)
+	defer it.Release()
+
+	for it.Next() {
+		var v versionRecord
+		if err := json.Unmarshal(it.Value(), &v); err != nil {
+			log.Printf("versions: invalid record of %s: %s\n", key, err)
+			continue
+		}
+		records = append(records, &v)
+	}
+	return records
+}
+
+// latestVersion returns the newest recorded version of key or nil if the key
+// has no recorded versions.
+func (e *Engine) latestVersion(key []byte) *versionRecord {
+	records := e.versionRecords(key)
+	if len(records) == 0 {
+		return nil
+	}
+	return records[len(records)-1]
+}
+
+// versions returns every version of key, oldest first. The record of the
+// latest version may be out of date, since repairs and balancing only update
+// the entry, so it's taken from the entry instead.
+func (e *Engine) versions(key []byte, ent entry.Entry) []*versionRecord {
+	records := e.versionRecords(key)
+	if ent.Status != entry.Exists {
+		return records
+	}
+
+	for _, v := range records {
+		if v.ID == ent.Version {
+			v.set(ent)
+			return records
+		}
+	}
+
+	v := &versionRecord{ID: ent.Version, Created: versionTime(ent.Version)}
+	v.set(ent)
+	records = append(records, v)
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// newVersionID returns a version id that is newer than any existing version of
+// key.
+func (e *Engine) newVersionID(key []byte) string {
+	id := uint64(time.Now().UnixNano())
+	if latest := e.latestVersion(key); latest != nil {
+		if n, err := strconv.ParseUint(latest.ID, 16, 64); err == nil && n >= id {
+			id = n + 1
+		}
+	}
+	return fmt.Sprintf("%016x", id)
+}
+
+// archive records the current entry of key as a version before it's replaced.
+func (e *Engine) archive(key []byte, ent entry.Entry) error {
+	if ent.Status != entry.Exists {
+		return nil
+	}
+
+	v, err := e.getVersion(key, ent.Version)
+	if err != nil {
+		v = &versionRecord{ID: ent.Version, Created: versionTime(ent.Version)}
+	}
+	v.set(ent)
+
+	return e.putVersion(key, v)
+}
+
+// findVersion returns the version of key with the given api id.
+func (e *Engine) findVersion(key []byte, ent entry.Entry, id string) (*versionRecord, bool) {
+	if id == nullVersion {
+		id = ""
+	}
+
+	for _, v := range e.versions(key, ent) {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// promote points the entry of key to the latest remaining version after a
+// version has been deleted.
+func (e *Engine) promote(key []byte) error {
+	latest := e.latestVersion(key)
+	if latest == nil || latest.DeleteMarker {
+		return e.DB.Delete(key, nil)
+	}
+
+	ent := e.Get(key)
+	if ent.Status == entry.Exists && ent.Version == latest.ID {
+		return nil
+	}
+	return e.Put(key, latest.entry())
+}
+
+func (e *Engine) serveVersions(w http.ResponseWriter, key []byte) {
+	ent := e.Get(key)
+	records := e.versions(key, ent)
+	if len(records) == 0 {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	versions := make([]Version, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		v := records[i]
+		version := Version{
+			VersionID:    versionID(v.ID),
+			Hash:         v.Hash,
+			Size:         v.Size,
+			DeleteMarker: v.DeleteMarker,
+			Created:      v.Created,
+			Latest:       i == len(records)-1,
+		}
+
+		if v.Hash != "" {
+			version.HashAlgo = v.HashAlgo.String()
+		}
+		versions = append(versions, version)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versions)
+}
+
+// hide hides key behind a new delete marker. The existing versions are kept.
+func (e *Engine) hide(key []byte) (*versionRecord, error) {
+	if err := e.archive(key, e.Get(key)); err != nil {
+		return nil, err
+	}
+
+	marker := &versionRecord{
+		ID:           e.newVersionID(key),
+		DeleteMarker: true,
+		Created:      time.Now(),
+	}
+	if err := e.putVersion(key, marker); err != nil {
+		return nil, err
+	}
+
+	return marker, e.DB.Delete(key, nil)
+}
+
+// deleteLatest handles deleting a key with versioning.
+func (e *Engine) deleteLatest(w http.ResponseWriter, key []byte) {
+	marker, err := e.hide(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(versionHeader, marker.ID)
+	w.Header().Set(deleteMarkerHeader, "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteVersion permanently deletes a version of key. Deleting the latest
+// delete marker makes the previous version visible again.
+func (e *Engine) deleteVersion(w http.ResponseWriter, key []byte, id string) {
+	v, ok := e.findVersion(key, e.Get(key), id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !v.DeleteMarker {
+		if err := e.removeValue(key, v.entry()); err != nil {
+			log.Printf("failed deleting version %s of %s: %s\n", id, key, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := e.DB.Delete(versionKey(key, v.ID), nil); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := e.promote(key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(versionHeader, versionID(v.ID))
+	if v.DeleteMarker {
+		w.Header().Set(deleteMarkerHeader, "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restore writes an old version of key as its latest version.
+func (e *Engine) restore(w http.ResponseWriter, r *http.Request, key []byte, id string) {
+	if !e.Versioning {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	v, ok := e.findVersion(key, e.Get(key), id)
+	if !ok || v.DeleteMarker {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rc, size := e.openValue(r.Context(), key, e.blobEntry(key, v.entry()))
+	if rc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	status := e.WriteToStorage(key, rc, size, PutOptions{ContentType: v.ContentType, Meta: v.Meta})
+	if status == http.StatusCreated {
+		w.Header().Set(versionHeader, e.Get(key).Version)
+	}
+	w.WriteHeader(status)
+}
@@ -0,0 +1,52 @@
+package entry
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// HashAlgo is the algorithm of the checksum stored in an entry. Entries written
+// before the algorithm was stored only have md5 checksums, so md5 is the zero
+// value.
+type HashAlgo uint8
+
+const (
+	MD5 HashAlgo = iota
+	SHA256
+	BLAKE3
+)
+
+var hashAlgoNames = []string{"md5", "sha256", "blake3"}
+
+func (a HashAlgo) String() string {
+	if int(a) < len(hashAlgoNames) {
+		return hashAlgoNames[a]
+	}
+	return fmt.Sprintf("HashAlgo(%d)", a)
+}
+
+// ParseHashAlgo returns the hash algorithm with the given name.
+func ParseHashAlgo(name string) (HashAlgo, error) {
+	for i, n := range hashAlgoNames {
+		if n == name {
+			return HashAlgo(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm: %s", name)
+}
+
+// New returns a new hash computing the checksum.
+func (a HashAlgo) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case BLAKE3:
+		return blake3.New()
+	default:
+		return md5.New()
+	}
+}
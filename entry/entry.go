@@ -1,16 +1,20 @@
 package entry
 
+// entry.go implements the entries stored in the index. Entries are encoded in
+// a binary format that begins with a format version byte, followed by tagged
+// and length prefixed fields. Fields with unknown tags are skipped, so new
+// fields can be added without breaking older readers. Entries written in the
+// old string format are still readable, see legacy.go.
+
 import (
-	"bytes"
 	"encoding/binary"
-	"math"
-	"strings"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
 )
 
-// TODO: Make entry serialization and deserialization faster somehow. Since
-// manipulating strings (joining|splitting) is not that fast and makes a lot of
-// not necessary allocations.
-
 type DeletionStatus int
 
 const (
@@ -23,110 +27,432 @@ type Entry struct {
 	Storages []string
 	Status   DeletionStatus
 	Hash     string
+
+	// HashAlgo is the algorithm of Hash.
+	HashAlgo HashAlgo
+
+	// Version is the id of the version the entry points to. Values written
+	// without versioning have an empty version, or the id of a temporary path
+	// if they replaced an earlier value.
+	Version string
+
+	// Size is the size of the value in bytes and ContentType is the content
+	// type given by the client when writing the value.
+	Size        int64
+	ContentType string
+
+	// Created is when the key was first written and Modified is when the
+	// current value was written. Entries written before the times were
+	// stored, have zero times.
+	Created  time.Time
+	Modified time.Time
+
+	// Meta is the metadata given by the client. The names are lower case.
+	Meta map[string]string
+
+	// Expires is when the value expires. Zero means never.
+	Expires time.Time
+
+	// Group is the storage group holding the value. Values in the default
+	// storages have an empty group.
+	Group string
+
+	// DeletedAt is when the value was moved into the trash. Entries in the
+	// trash are soft deleted.
+	DeletedAt time.Time
+
+	// DataShards and ParityShards are the amount of Reed-Solomon shards of an
+	// erasure coded value, in which case Storages contains the storage of each
+	// shard in order. The shards consist of blocks of BlockSize bytes.
+	// Replicated values have no shards.
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+
+	// Chunks are the chunks of a value that is stored in parts. The chunks
+	// are replicated on their own storages, and Storages is empty.
+	Chunks []Chunk
+
+	// ETag is the etag of a value whose etag is not its checksum, like the
+	// values completed from multipart uploads. Other values have no ETag.
+	ETag string
+
+	// Dedup is set on replicated values that are stored in a blob shared by
+	// every value with the same content. The path of the blob is derived from
+	// the checksum, see BlobPath.
+	Dedup bool
 }
 
-// EntryFromBytes creates a entry struct from a given byte array. It first converts
-// the bytes into a strings on which analysis is easier.
-func EntryFromBytes(b []byte) Entry {
-	var e Entry
-	s := string(b)
-	e.Status = Exists
-	e.Hash = ""
+// Chunk is a single part of a value stored in chunks.
+type Chunk struct {
+	Storages []string `json:"storages"`
+	Size     int64    `json:"size"`
+
+	// ID tells apart the files of a chunk that was uploaded as a part of a
+	// multipart upload, since every upload of the part has its own file. Other
+	// chunks have no ID.
+	ID string `json:"id,omitempty"`
+}
+
+// TrashSuffix is appended to the path of values in the trash.
+const TrashSuffix = ".trash"
+
+// Trashed reports whether the value is in the trash.
+func (e *Entry) Trashed() bool {
+	return e.Status == SoftDeleted && !e.DeletedAt.IsZero()
+}
+
+// Expired reports whether the entry has expired at the given time.
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// Sharded reports whether the value is erasure coded.
+func (e *Entry) Sharded() bool {
+	return e.DataShards > 0
+}
+
+// Chunked reports whether the value is stored in chunks.
+func (e *Entry) Chunked() bool {
+	return len(e.Chunks) > 0
+}
+
+// ChunkPath returns the path of the i'th chunk of the value at path.
+func ChunkPath(path string, i int) string {
+	return path + ".c" + strconv.Itoa(i)
+}
 
-	if strings.HasPrefix(s, "DELETE") {
-		e.Status = SoftDeleted
-		s = s[6:]
+// Path returns the path of the chunk when it's the i'th chunk of the value at
+// path.
+func (c *Chunk) Path(path string, i int) string {
+	if c.ID == "" {
+		return ChunkPath(path, i)
 	}
+	return ChunkPath(path, i) + "." + c.ID
+}
 
-	if strings.HasPrefix(s, "HASH") {
-		e.Hash = s[4:36]
-		s = s[36:]
+// ShardPath returns the path of the i'th shard of the value at path.
+func ShardPath(path string, i int) string {
+	return path + ".s" + strconv.Itoa(i)
+}
+
+// FilePath returns the path of the file on the i'th storage of the entry. The
+// shards of an erasure coded value have their own paths, so a storage can hold
+// multiple shards while they're moved around.
+func (e *Entry) FilePath(key []byte, i int) string {
+	if !e.Sharded() {
+		return e.Path(key)
 	}
-	e.Storages = strings.Split(s, ",")
+	return ShardPath(e.Path(key), i)
+}
 
+// BlobPath returns the path of the blob holding the values with the given
+// checksum. The dash isn't in the base64 alphabet, so blobs can't be mistaken
+// for the values of keys.
+func BlobPath(algo HashAlgo, hash string) string {
+	if len(hash) < 4 {
+		return fmt.Sprintf("/%s-%s", algo, hash)
+	}
+	return fmt.Sprintf("/%s/%s/%s-%s", hash[:2], hash[2:4], algo, hash)
+}
+
+// Path returns the path of the entry's value on the storages. Every version of
+// a key is stored in its own file, and values in the trash have their own path
+// as well. Deduplicated values are in the path of their blob.
+func (e *Entry) Path(key []byte) string {
+	if e.Dedup {
+		return BlobPath(e.HashAlgo, e.Hash)
+	}
+
+	path := HashKey(key)
+	if e.Version != "" {
+		path += "." + e.Version
+	}
+
+	if !e.DeletedAt.IsZero() {
+		path += TrashSuffix
+	}
+	return path
+}
+
+// formatV1 is the first version of the binary format. The legacy format never
+// begins with a byte below 0x20, since it begins with a text prefix or a
+// storage address.
+const formatV1 byte = 1
+
+// field tags of the binary format. New tags are added at the end, so that the
+// tags of stored entries keep their meaning.
+const (
+	tagStatus byte = iota + 1
+	tagHash
+	tagVersion
+	tagStorage
+	tagHashAlgo
+	tagSize
+	tagContentType
+	tagCreated
+	tagModified
+	tagMeta
+	tagExpires
+	tagGroup
+	tagDeletedAt
+	tagShards
+	tagChunk
+	tagETag
+	tagChunkID
+	tagDedup
+)
+
+var errMalformed = errors.New("malformed entry")
+
+// IsLegacy reports whether b is an entry in the legacy string format.
+func IsLegacy(b []byte) bool {
+	return len(b) == 0 || b[0] >= 0x20
+}
+
+// EntryFromBytes decodes an entry in either the binary or the legacy format.
+// Malformed entries are decoded as far as possible.
+func EntryFromBytes(b []byte) Entry {
+	if IsLegacy(b) {
+		return legacyFromBytes(b)
+	}
+
+	e, _ := decode(b)
 	return e
 }
 
-func (e *Entry) ToBytes() []byte {
-	// TODO: probably optimize with string builder
-	prefixStr := ""
-	if e.Status == HardDeleted {
-		panic("cannot put hard delete")
+func decode(b []byte) (Entry, error) {
+	e := Entry{Storages: []string{}, Status: Exists}
+	if len(b) == 0 || b[0] != formatV1 {
+		return e, errMalformed
 	}
+	b = b[1:]
+
+	for len(b) > 0 {
+		tag := b[0]
+		n, l := binary.Uvarint(b[1:])
+		if l <= 0 || uint64(len(b)-1-l) < n {
+			return e, errMalformed
+		}
+		field := b[1+l : 1+l+int(n)]
+		b = b[1+l+int(n):]
 
-	if e.Status == SoftDeleted {
-		prefixStr = "DELETE"
+		switch tag {
+		case tagStatus:
+			if len(field) == 1 {
+				e.Status = DeletionStatus(field[0])
+			}
+		case tagHash:
+			e.Hash = string(field)
+		case tagVersion:
+			e.Version = string(field)
+		case tagStorage:
+			e.Storages = append(e.Storages, string(field))
+		case tagHashAlgo:
+			if len(field) == 1 {
+				e.HashAlgo = HashAlgo(field[0])
+			}
+		case tagSize:
+			if n, l := binary.Uvarint(field); l > 0 {
+				e.Size = int64(n)
+			}
+		case tagContentType:
+			e.ContentType = string(field)
+		case tagCreated:
+			e.Created = decodeTime(field)
+		case tagModified:
+			e.Modified = decodeTime(field)
+		case tagMeta:
+			// the name is length prefixed and followed by the value.
+			n, l := binary.Uvarint(field)
+			if l <= 0 || uint64(len(field)-l) < n {
+				return e, errMalformed
+			}
+
+			if e.Meta == nil {
+				e.Meta = make(map[string]string)
+			}
+			e.Meta[string(field[l:l+int(n)])] = string(field[l+int(n):])
+		case tagExpires:
+			e.Expires = decodeTime(field)
+		case tagGroup:
+			e.Group = string(field)
+		case tagDeletedAt:
+			e.DeletedAt = decodeTime(field)
+		case tagShards:
+			// the amounts of data and parity shards and the block size.
+			var v [3]uint64
+			for i := range v {
+				n, l := binary.Uvarint(field)
+				if l <= 0 {
+					return e, errMalformed
+				}
+				v[i], field = n, field[l:]
+			}
+			e.DataShards, e.ParityShards, e.BlockSize = int(v[0]), int(v[1]), int(v[2])
+		case tagChunk:
+			// the size of the chunk followed by its length prefixed storages.
+			n, l := binary.Uvarint(field)
+			if l <= 0 {
+				return e, errMalformed
+			}
+			c := Chunk{Storages: []string{}, Size: int64(n)}
+
+			for field = field[l:]; len(field) > 0; {
+				n, l := binary.Uvarint(field)
+				if l <= 0 || uint64(len(field)-l) < n {
+					return e, errMalformed
+				}
+				c.Storages = append(c.Storages, string(field[l:l+int(n)]))
+				field = field[l+int(n):]
+			}
+			e.Chunks = append(e.Chunks, c)
+		case tagETag:
+			e.ETag = string(field)
+		case tagChunkID:
+			// the id belongs to the chunk before it.
+			if len(e.Chunks) == 0 {
+				return e, errMalformed
+			}
+			e.Chunks[len(e.Chunks)-1].ID = string(field)
+		case tagDedup:
+			e.Dedup = true
+		}
 	}
 
-	if len(e.Hash) == 32 {
-		prefixStr += "HASH" + e.Hash
+	return e, nil
+}
+
+// times are stored as nanoseconds since the unix epoch.
+func decodeTime(field []byte) time.Time {
+	n, l := binary.Varint(field)
+	if l <= 0 {
+		return time.Time{}
 	}
-	return []byte(prefixStr + strings.Join(e.Storages, ","))
+	return time.Unix(0, n).UTC()
 }
 
-func (e *Entry) SerializeExperimental() []byte {
+func encodeTime(t time.Time) []byte {
+	return binary.AppendVarint(nil, t.UnixNano())
+}
+
+func appendField(b []byte, tag byte, field []byte) []byte {
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// ToBytes encodes the entry in the binary format.
+func (e *Entry) ToBytes() []byte {
 	if e.Status == HardDeleted {
-		panic("cannot serialize hard delete")
+		panic("cannot put hard delete")
+	}
+
+	size := 1 + 3 + 3 + len(e.Hash) + 3 + len(e.ETag) + 3 + 3 + len(e.Version) + 3 + len(e.ContentType) + 3 + len(e.Group) + 3*16
+	for name, value := range e.Meta {
+		size += len(name) + len(value) + 6
+	}
+	for _, s := range e.Storages {
+		size += len(s) + 3
 	}
-	b := bytes.NewBuffer(nil)
-	if e.Status == SoftDeleted {
-		a := make([]byte, 2)
-		binary.LittleEndian.PutUint16(a, math.MaxUint16)
-		b.Write(a)
+	for _, c := range e.Chunks {
+		size += 12 + 3 + len(c.ID)
+		for _, s := range c.Storages {
+			size += len(s) + 2
+		}
 	}
 
-	if len(e.Hash) == 32 {
-		a := make([]byte, 2)
-		binary.LittleEndian.PutUint16(a, math.MaxUint16-1)
-		b.Write(a)
-		b.Write([]byte(e.Hash))
+	b := make([]byte, 0, size)
+	b = append(b, formatV1)
+
+	if e.Status != Exists {
+		b = appendField(b, tagStatus, []byte{byte(e.Status)})
 	}
 
-	for idx := range e.Storages {
-		b.Write([]byte(e.Storages[idx]))
-		if idx != len(e.Storages)-1 {
-			b.Write([]byte{','})
+	if e.Hash != "" {
+		b = appendField(b, tagHash, []byte(e.Hash))
+		if e.HashAlgo != MD5 {
+			b = appendField(b, tagHashAlgo, []byte{byte(e.HashAlgo)})
 		}
 	}
-	return b.Bytes()
-}
 
-func DeserializeExperimental(b []byte) Entry {
-	var e Entry
-	e.Status = Exists
-	e.Storages = []string{}
+	if e.Version != "" {
+		b = appendField(b, tagVersion, []byte(e.Version))
+	}
 
-	// read prefixes properly first
-	pref := binary.LittleEndian.Uint16(b[0:2])
-	if pref == math.MaxUint16 {
-		// we have deletion
-		e.Status = SoftDeleted
-		pref = binary.LittleEndian.Uint16(b[2:4])
+	for _, s := range e.Storages {
+		b = appendField(b, tagStorage, []byte(s))
 	}
 
-	if pref == (math.MaxUint16 - 1) {
-		// we have a hash
-		e.Hash = string(b[4:36])
-		b = b[36:]
+	if e.Size > 0 {
+		b = appendField(b, tagSize, binary.AppendUvarint(nil, uint64(e.Size)))
 	}
 
-	temp := make([]byte, 48)
-	pos := 0
-	// parse storages
-	for idx := range b {
-		if b[idx] == byte(',') {
-			e.Storages = append(e.Storages, string(temp[:pos]))
-			pos = 0
-		}
+	if e.ContentType != "" {
+		b = appendField(b, tagContentType, []byte(e.ContentType))
+	}
+
+	if !e.Created.IsZero() {
+		b = appendField(b, tagCreated, encodeTime(e.Created))
+	}
+
+	if !e.Modified.IsZero() {
+		b = appendField(b, tagModified, encodeTime(e.Modified))
+	}
+
+	if !e.Expires.IsZero() {
+		b = appendField(b, tagExpires, encodeTime(e.Expires))
+	}
+
+	if e.Group != "" {
+		b = appendField(b, tagGroup, []byte(e.Group))
+	}
+
+	if !e.DeletedAt.IsZero() {
+		b = appendField(b, tagDeletedAt, encodeTime(e.DeletedAt))
+	}
 
-		temp[pos] = b[idx]
-		pos++
+	if e.Sharded() {
+		field := binary.AppendUvarint(nil, uint64(e.DataShards))
+		field = binary.AppendUvarint(field, uint64(e.ParityShards))
+		field = binary.AppendUvarint(field, uint64(e.BlockSize))
+		b = appendField(b, tagShards, field)
+	}
+
+	for _, c := range e.Chunks {
+		field := binary.AppendUvarint(nil, uint64(c.Size))
+		for _, s := range c.Storages {
+			field = binary.AppendUvarint(field, uint64(len(s)))
+			field = append(field, s...)
+		}
+		b = appendField(b, tagChunk, field)
 
-		if idx == len(b)-1 {
-			e.Storages = append(e.Storages, string(temp[:pos]))
-			pos = 0
+		if c.ID != "" {
+			b = appendField(b, tagChunkID, []byte(c.ID))
 		}
 	}
 
-	return e
+	if e.ETag != "" {
+		b = appendField(b, tagETag, []byte(e.ETag))
+	}
+
+	if e.Dedup {
+		b = appendField(b, tagDedup, nil)
+	}
+
+	// the metadata is sorted to keep the encoding stable.
+	names := make([]string, 0, len(e.Meta))
+	for name := range e.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := binary.AppendUvarint(nil, uint64(len(name)))
+		field = append(field, name...)
+		field = append(field, e.Meta[name]...)
+		b = appendField(b, tagMeta, field)
+	}
+
+	return b
 }
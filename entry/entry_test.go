@@ -2,26 +2,49 @@ package entry_test
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/nireo/jakaja/entry"
 )
 
 func Test_entrySerialization(t *testing.T) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("testhash")))
+	sha256hash := fmt.Sprintf("%x", sha256.Sum256([]byte("testhash")))
 
 	entries := []entry.Entry{
 		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: hash},
 		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.SoftDeleted, Hash: ""},
 		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.SoftDeleted, Hash: hash},
 		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: ""},
+		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: hash, Version: "0123456789abcdef"},
+		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.SoftDeleted, Hash: "", Version: "0123456789abcdef"},
+		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: sha256hash, HashAlgo: entry.SHA256},
+		{Storages: []string{"localhost:1"}, Status: entry.Exists, Hash: sha256hash, HashAlgo: entry.BLAKE3, Version: "0123456789abcdef"},
+		{Storages: []string{"http://a,b", "file:///data/a,b"}, Status: entry.Exists},
+		{Storages: []string{}, Status: entry.Exists},
+		{Storages: []string{"localhost:1"}, Status: entry.Exists, Hash: hash, Size: 1 << 40, ContentType: "text/plain",
+			Created: time.Unix(0, 1600000000123456789).UTC(), Modified: time.Unix(1700000000, 0).UTC()},
+		{Storages: []string{"localhost:1"}, Status: entry.Exists, Meta: map[string]string{"uploader": "1234", "empty": "", "": "x"}},
+		{Storages: []string{"localhost:1"}, Status: entry.Exists, Expires: time.Unix(1700000000, 0).UTC()},
+		{Storages: []string{"cold:1", "cold:2"}, Status: entry.Exists, Group: "cold"},
+		{Storages: []string{"localhost:1"}, Status: entry.SoftDeleted, Version: "0000000000000001", DeletedAt: time.Unix(1700000000, 0).UTC()},
+		{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, DataShards: 2, ParityShards: 1, BlockSize: 1 << 16},
+		{Storages: []string{}, Status: entry.Exists, Size: 5 << 20, Chunks: []entry.Chunk{{Storages: []string{"localhost:1", "localhost:2"}, Size: 4 << 20}, {Storages: []string{"localhost:3"}, Size: 1 << 20, ID: "0123456789abcdef"}},
+			ETag: "0123456789abcdef0123456789abcdef-2"},
+		{Storages: []string{"localhost:1", "localhost:2"}, Status: entry.Exists, Hash: sha256hash, HashAlgo: entry.SHA256, Version: "0123456789abcdef", Dedup: true},
 	}
 
 	for idx, ent := range entries {
 		byteArray := ent.ToBytes()
 
+		if entry.IsLegacy(byteArray) {
+			t.Fatalf("entry %d was encoded in the legacy format", idx)
+		}
+
 		if !reflect.DeepEqual(entry.EntryFromBytes(byteArray), ent) {
 			fmt.Println(entry.EntryFromBytes(byteArray), ent)
 			t.Fatalf("failed to serialize/unserialize entry %d", idx)
@@ -29,40 +52,65 @@ func Test_entrySerialization(t *testing.T) {
 	}
 }
 
-func Benchmark_entrySerializationString(b *testing.B) {
-	b.ReportAllocs()
-	entry := entry.Entry{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: ""}
+func Test_unknownFields(t *testing.T) {
+	ent := entry.Entry{Storages: []string{"localhost:1"}, Status: entry.Exists, Hash: "hash"}
 
-	for i := 0; i < b.N; i++ {
-		entry.ToBytes()
+	// a field added by a newer version is skipped.
+	b := append(ent.ToBytes(), 0xff, 3, 'n', 'e', 'w')
+	if !reflect.DeepEqual(entry.EntryFromBytes(b), ent) {
+		t.Fatalf("unknown field was not skipped: %+v", entry.EntryFromBytes(b))
 	}
 }
 
-func Benchmark_entryDeserializationString(b *testing.B) {
-	b.ReportAllocs()
-	ent := entry.Entry{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: ""}
-	by := ent.ToBytes()
+func Test_legacyEntry(t *testing.T) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("testhash")))
+	storages := []string{"localhost:1", "localhost:2", "localhost:3"}
 
-	for i := 0; i < b.N; i++ {
-		entry.EntryFromBytes(by)
+	tests := []struct {
+		legacy string
+		ent    entry.Entry
+	}{
+		{"localhost:1,localhost:2,localhost:3", entry.Entry{Storages: storages, Status: entry.Exists}},
+		{"DELETElocalhost:1,localhost:2,localhost:3", entry.Entry{Storages: storages, Status: entry.SoftDeleted}},
+		{"HASH" + hash + "localhost:1,localhost:2,localhost:3", entry.Entry{Storages: storages, Status: entry.Exists, Hash: hash}},
+		{"DELETEHASH" + hash + "localhost:1,localhost:2,localhost:3", entry.Entry{Storages: storages, Status: entry.SoftDeleted, Hash: hash}},
+	}
+
+	for idx, tc := range tests {
+		if !entry.IsLegacy([]byte(tc.legacy)) {
+			t.Fatalf("entry %d was not detected as legacy", idx)
+		}
+
+		if ent := entry.EntryFromBytes([]byte(tc.legacy)); !reflect.DeepEqual(ent, tc.ent) {
+			t.Fatalf("failed to read legacy entry %d: %+v", idx, ent)
+		}
 	}
 }
 
-func Benchmark_entrySerializationBytes(b *testing.B) {
+func Benchmark_entrySerialization(b *testing.B) {
 	b.ReportAllocs()
 	entry := entry.Entry{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: ""}
 
 	for i := 0; i < b.N; i++ {
-		entry.SerializeExperimental()
+		entry.ToBytes()
 	}
 }
 
-func Benchmark_entryDeserializationByte(b *testing.B) {
+func Benchmark_entryDeserialization(b *testing.B) {
 	b.ReportAllocs()
 	ent := entry.Entry{Storages: []string{"localhost:1", "localhost:2", "localhost:3"}, Status: entry.Exists, Hash: ""}
 	by := ent.ToBytes()
 
 	for i := 0; i < b.N; i++ {
-		entry.DeserializeExperimental(by)
+		entry.EntryFromBytes(by)
+	}
+}
+
+func Benchmark_entryDeserializationLegacy(b *testing.B) {
+	b.ReportAllocs()
+	by := []byte("localhost:1,localhost:2,localhost:3")
+
+	for i := 0; i < b.N; i++ {
+		entry.EntryFromBytes(by)
 	}
 }
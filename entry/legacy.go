@@ -0,0 +1,27 @@
+package entry
+
+import "strings"
+
+// legacyFromBytes decodes an entry in the legacy string format, which consists
+// of optional prefixes followed by the comma separated storages:
+// - DELETE: the entry is soft deleted
+// - HASH<md5>: a 32 character md5 checksum
+func legacyFromBytes(b []byte) Entry {
+	var e Entry
+	s := string(b)
+	e.Status = Exists
+	e.Hash = ""
+
+	if strings.HasPrefix(s, "DELETE") {
+		e.Status = SoftDeleted
+		s = s[6:]
+	}
+
+	if strings.HasPrefix(s, "HASH") && len(s) >= 36 {
+		e.Hash = s[4:36]
+		s = s[36:]
+	}
+	e.Storages = strings.Split(s, ",")
+
+	return e
+}
@@ -2,7 +2,14 @@ module github.com/nireo/jakaja
 
 go 1.19
 
+require (
+	github.com/klauspost/reedsolomon v1.9.3
+	github.com/syndtr/goleveldb v1.0.0
+	github.com/zeebo/blake3 v0.2.3
+)
+
 require (
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
+	github.com/klauspost/cpuid v1.3.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 )
@@ -6,10 +6,13 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/nireo/jakaja/engine"
+	"github.com/nireo/jakaja/entry"
+	"github.com/nireo/jakaja/volume"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -21,10 +24,50 @@ func main() {
 	replicaCount := flag.Int("replica", 3, "The amount of replicas to make out of a file")
 	substorageCount := flag.Int("substorage", 10, "The amount of substorages")
 	storages := flag.String("storage", "", "The storage servers in which to store files in.")
-	action := flag.String("action", "serve", "The action you want the server to do: serve, rebuild")
+	stallTimeout := flag.Duration("stall-timeout", 30*time.Second, "Abort writes if a storage server doesn't make progress in this time")
+	writeQuorum := flag.Int("write-quorum", 0, "The amount of replicas that need to acknowledge a write, 0 means every replica")
+	readQuorum := flag.Int("read-quorum", 1, "The amount of replicas that need to have a value when reading")
+	readMode := flag.String("read-mode", engine.ReadModeRedirect, "How values are read: redirect, proxy")
+	repairInterval := flag.Duration("repair-interval", 30*time.Second, "How often the repair queue is processed")
+	scrubInterval := flag.Duration("scrub-interval", 0, "How often values are verified in the background, 0 disables scrubbing")
+	scrubRate := flag.Int64("scrub-rate", 10<<20, "The maximum amount of bytes read per second when scrubbing")
+	repairCorrupt := flag.Bool("repair-corrupt", false, "Replace missing and corrupt replicas found by verification")
+	hashAlgo := flag.String("hash", "md5", "The checksum algorithm of new values: md5, sha256, blake3")
+	gcDelay := flag.Duration("gc-delay", time.Minute, "How long the files of overwritten values are kept for reads still using them")
+	reapInterval := flag.Duration("reap-interval", time.Minute, "How often expired values are deleted")
+	lifecyclePath := flag.String("lifecycle", "", "A json file containing storage groups and lifecycle rules")
+	lifecycleInterval := flag.Duration("lifecycle-interval", time.Hour, "How often the lifecycle rules are applied")
+	auditLogPath := flag.String("audit-log", "", "A file where the actions of the lifecycle rules are appended, by default they're logged")
+	trashRetention := flag.Duration("trash-retention", 0, "How long deleted values are kept in the trash, 0 deletes values right away")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "How often values older than the trash retention are removed")
+	erasure := flag.String("ec", "", "Erasure code new values instead of replicating them, for example 6+3 for 6 data and 3 parity shards")
+	chunkSize := flag.Int64("chunk-size", 0, "Store values larger than this many bytes in chunks of this size, 0 disables chunking")
+	uploadExpiry := flag.Duration("upload-expiry", 24*time.Hour, "How long unfinished multipart uploads are kept, 0 keeps them forever")
+	s3Port := flag.Int("s3-port", 0, "The port of the S3 compatible gateway, 0 disables the gateway")
+	s3CredentialsPath := flag.String("s3-credentials", "", "A json file containing the access keys of the S3 gateway")
+	versioning := flag.Bool("versioning", false, "Keep every written version of a key")
+	dedup := flag.Bool("dedup", false, "Store replicated values with identical content only once, requires --hash=sha256 or --hash=blake3")
+	volumeDir := flag.String("volume", "", "The directory served with --action=volume")
+	action := flag.String("action", "serve", "The action you want the server to do: serve, build, balance, verify, migrate-index, lifecycle, volume")
 
 	flag.Parse()
 
+	// serving a volume doesn't need the index or the other storages.
+	if *action == "volume" {
+		if *volumeDir == "" {
+			log.Fatalln("jakaja: volume directory not provided")
+		}
+
+		if err := os.MkdirAll(*volumeDir, 0755); err != nil {
+			log.Fatalln("jakaja: failed to create volume directory:", err)
+		}
+
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), volume.NewServer(*volumeDir)); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	// validate command line arguments
 	if *storages == "" {
 		log.Fatalln("jakaja: storage information not provided")
@@ -36,6 +79,68 @@ func main() {
 		log.Fatalln("jakaja: The amount of required replicas is larger than the amount of files")
 	}
 
+	if *writeQuorum > *replicaCount || *readQuorum > *replicaCount {
+		log.Fatalln("jakaja: quorum cannot be larger than the amount of replicas")
+	}
+
+	if *readMode != engine.ReadModeRedirect && *readMode != engine.ReadModeProxy {
+		log.Fatalln("jakaja: unrecognized read mode")
+	}
+
+	algo, err := entry.ParseHashAlgo(*hashAlgo)
+	if err != nil {
+		log.Fatalln("jakaja:", err)
+	}
+
+	// values with colliding checksums would share a blob.
+	if *dedup && algo == entry.MD5 {
+		log.Fatalln("jakaja: deduplication needs a collision resistant checksum")
+	}
+
+	// every shard of an erasure coded value needs its own storage.
+	dataShards, parityShards, shardCount := 0, 0, *replicaCount
+	if *erasure != "" {
+		if dataShards, parityShards, err = engine.ParseErasure(*erasure); err != nil {
+			log.Fatalln("jakaja:", err)
+		}
+
+		if len(storageList) < dataShards+parityShards {
+			log.Fatalln("jakaja: erasure coding needs a storage for every shard")
+		}
+
+		if dataShards+parityShards > shardCount {
+			shardCount = dataShards + parityShards
+		}
+	}
+
+	if *chunkSize < 0 {
+		log.Fatalln("jakaja: chunk size cannot be negative")
+	}
+
+	var s3Credentials []engine.S3Credential
+	if *s3Port > 0 {
+		if *s3CredentialsPath == "" {
+			log.Fatalln("jakaja: the S3 gateway needs credentials")
+		}
+
+		if s3Credentials, err = engine.LoadS3Credentials(*s3CredentialsPath); err != nil {
+			log.Fatalln("jakaja: failed to load S3 credentials:", err)
+		}
+	}
+
+	var lifecycle *engine.Lifecycle
+	if *lifecyclePath != "" {
+		if lifecycle, err = engine.LoadLifecycle(*lifecyclePath); err != nil {
+			log.Fatalln("jakaja: failed to load lifecycle rules:", err)
+		}
+
+		for name, group := range lifecycle.Groups {
+			if len(group) < shardCount {
+				log.Fatalf("jakaja: storage group %s has less storages than replicas or shards\n", name)
+			}
+		}
+	}
+
 	if *dbPath == "" {
 		log.Fatalln("jakaja: index database file not provided")
 	}
@@ -52,11 +157,66 @@ func main() {
 		Storages:        storageList,
 		ReplicaCount:    *replicaCount,
 		SubstorageCount: *substorageCount,
+		StallTimeout:    *stallTimeout,
+		WriteQuorum:     *writeQuorum,
+		ReadQuorum:      *readQuorum,
+		ReadMode:        *readMode,
+		Versioning:      *versioning,
+		GCDelay:         *gcDelay,
+		TrashRetention:  *trashRetention,
+		DataShards:      dataShards,
+		ParityShards:    parityShards,
+		ChunkSize:       *chunkSize,
+		UploadExpiry:    *uploadExpiry,
+		HashAlgo:        algo,
+		Dedup:           *dedup,
 		DB:              db,
 	}
 
+	if lifecycle != nil {
+		eng.Groups = lifecycle.Groups
+		eng.Lifecycle = lifecycle
+	}
+
+	if *auditLogPath != "" {
+		f, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalln("jakaja: failed to open audit log:", err)
+		}
+		defer f.Close()
+		eng.AuditLog = f
+	}
+
 	switch *action {
 	case "serve":
+		go eng.RepairWorker(*repairInterval)
+		go eng.GCWorker(*gcDelay)
+		go eng.ReapWorker(*reapInterval)
+		go eng.UploadReapWorker(*reapInterval)
+		if lifecycle != nil {
+			go eng.LifecycleWorker(*lifecycleInterval)
+		}
+
+		if *trashRetention > 0 {
+			go eng.PurgeWorker(*purgeInterval)
+		}
+		if *scrubInterval > 0 {
+			go eng.ScrubWorker(*scrubInterval, engine.VerifyOptions{
+				Workers: 1,
+				Rate:    *scrubRate,
+				Repair:  *repairCorrupt,
+			})
+		}
+
+		if *s3Port > 0 {
+			gateway := engine.NewS3Gateway(eng, s3Credentials)
+			go func() {
+				if err := http.ListenAndServe(fmt.Sprintf(":%d", *s3Port), gateway); err != nil {
+					panic(err)
+				}
+			}()
+		}
+
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), eng); err != nil {
 			panic(err)
 		}
@@ -64,6 +224,25 @@ func main() {
 		eng.Build()
 	case "balance":
 		eng.Balance()
+	case "verify":
+		report := eng.Verify(engine.VerifyOptions{Workers: 16, Repair: *repairCorrupt})
+		fmt.Printf("keys: %d, missing: %d, corrupt: %d, extra: %d, unreachable: %d, repaired: %d\n",
+			report.Keys, report.Missing, report.Corrupt, report.Extra, report.Unreachable, report.Repaired)
+		if !report.OK() {
+			db.Close()
+			os.Exit(1)
+		}
+	case "migrate-index":
+		migrated, err := eng.MigrateIndex()
+		if err != nil {
+			log.Fatalln("jakaja: failed to migrate index:", err)
+		}
+		fmt.Printf("migrated %d entries\n", migrated)
+	case "lifecycle":
+		if lifecycle == nil {
+			log.Fatalln("jakaja: lifecycle rules not provided")
+		}
+		eng.ApplyLifecycle()
 	default:
 		log.Fatalln("jakaja: unrecognized action")
 	}
@@ -0,0 +1,167 @@
+package volume
+
+// dir.go implements the volume driver for local directories. Files are first
+// written into a temporary file, which is synced to disk and then renamed into
+// place, so readers never see partially written files.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempPrefix is the prefix of temporary files. They're hidden from listings.
+const tempPrefix = ".tmp-"
+
+type dirVolume struct {
+	root string
+}
+
+// file returns the file system path of name. Cleaning the name before joining
+// ensures that the path cannot point outside of the root.
+func (v *dirVolume) file(name string) string {
+	return filepath.Join(v.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (v *dirVolume) Put(ctx context.Context, path string, body io.Reader, size int64) error {
+	name := v.file(path)
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	// remove the temporary file if anything goes wrong.
+	done := false
+	defer func() {
+		if !done {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	n, err := io.Copy(f, body)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && n != size {
+		return fmt.Errorf("dirput: body length %d does not match size %d", n, size)
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	done = true
+
+	// sync the directory so that the rename is durable. Not every platform
+	// supports syncing directories, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+func (v *dirVolume) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(v.file(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return limit(f, length), nil
+}
+
+func (v *dirVolume) Head(ctx context.Context, path string) (int64, error) {
+	info, err := os.Stat(v.file(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrNotFound
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return 0, ErrNotFound
+	}
+	return info.Size(), nil
+}
+
+func (v *dirVolume) Delete(ctx context.Context, path string) error {
+	err := os.Remove(v.file(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (v *dirVolume) List(ctx context.Context, dir string) ([]File, error) {
+	entries, err := os.ReadDir(v.file(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(entries))
+	for _, ent := range entries {
+		if strings.HasPrefix(ent.Name(), tempPrefix) {
+			continue
+		}
+
+		info, err := ent.Info()
+		if err != nil {
+			continue
+		}
+
+		f := File{Name: ent.Name(), Dir: ent.IsDir(), ModTime: info.ModTime()}
+		if !f.Dir {
+			f.Size = info.Size()
+		}
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
@@ -0,0 +1,204 @@
+package volume
+
+// http.go implements the volume driver for nginx WebDAV servers. The servers
+// need to allow the PUT and DELETE methods and serve directory listings in the
+// json autoindex format.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type httpVolume struct {
+	base string
+}
+
+func httpBase(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	return "http://" + strings.TrimSuffix(addr, "/")
+}
+
+func (v *httpVolume) URL(path string) string {
+	return v.base + path
+}
+
+func (v *httpVolume) do(ctx context.Context, method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, v.URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vals := range header {
+		req.Header[k] = vals
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+func (v *httpVolume) Put(ctx context.Context, path string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, v.URL(path), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("httpput: status code is not 201 or 204; got: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// typedBody is the body of a file read from the server along with the content
+// type and the size of the file given by the server.
+type typedBody struct {
+	io.ReadCloser
+	contentType string
+	size        int64
+}
+
+func (b typedBody) ContentType() string {
+	return b.contentType
+}
+
+func (b typedBody) Size() int64 {
+	return b.size
+}
+
+// rangeSize returns the size of the whole file from a Content-Range header of
+// the form "bytes first-last/size", or -1 if it's unknown.
+func rangeSize(s string) int64 {
+	_, total, ok := strings.Cut(s, "/")
+	if !ok {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (v *httpVolume) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if length >= 0 {
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, path, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return typedBody{resp.Body, resp.Header.Get("Content-Type"), rangeSize(resp.Header.Get("Content-Range"))}, nil
+	case http.StatusOK:
+		// the server ignored the range.
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return typedBody{limit(resp.Body, length), resp.Header.Get("Content-Type"), resp.ContentLength}, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// reading from the end of the file.
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("httpget: got status %d", resp.StatusCode)
+	}
+}
+
+func (v *httpVolume) Head(ctx context.Context, path string) (int64, error) {
+	resp, err := v.do(ctx, http.MethodHead, path, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, ErrNotFound
+	default:
+		return 0, fmt.Errorf("httphead: got status %d", resp.StatusCode)
+	}
+}
+
+func (v *httpVolume) Delete(ctx context.Context, path string) error {
+	resp, err := v.do(ctx, http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("httpdel: status code is not 204 or 404; got: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// autoindexFile is a single file in a nginx json autoindex listing.
+type autoindexFile struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+	Size  int64  `json:"size,omitempty"`
+}
+
+func (v *httpVolume) List(ctx context.Context, dir string) ([]File, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, dir, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("httplist: got status %d", resp.StatusCode)
+	}
+
+	var index []autoindexFile
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	files := make([]File, len(index))
+	for i, f := range index {
+		mtime, _ := http.ParseTime(f.MTime)
+		files[i] = File{Name: f.Name, Dir: f.Type == "directory", Size: f.Size, ModTime: mtime}
+	}
+	return files, nil
+}
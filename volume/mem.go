@@ -0,0 +1,139 @@
+package volume
+
+// mem.go implements a volume driver that stores files in memory. Volumes with
+// the same name share the same files, so a substorage such as mem://a/sv01 is a
+// directory in the volume mem://a.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memStore struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+var memStores = struct {
+	sync.Mutex
+	m map[string]*memStore
+}{m: make(map[string]*memStore)}
+
+type memVolume struct {
+	store  *memStore
+	prefix string
+}
+
+func openMem(addr string) *memVolume {
+	name, prefix := addr, ""
+	if idx := strings.Index(addr, "/"); idx >= 0 {
+		name, prefix = addr[:idx], strings.TrimSuffix(addr[idx:], "/")
+	}
+
+	memStores.Lock()
+	defer memStores.Unlock()
+
+	store, ok := memStores.m[name]
+	if !ok {
+		store = &memStore{files: make(map[string][]byte)}
+		memStores.m[name] = store
+	}
+
+	return &memVolume{store: store, prefix: prefix}
+}
+
+func (v *memVolume) Put(ctx context.Context, path string, body io.Reader, size int64) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && int64(len(b)) != size {
+		return fmt.Errorf("memput: body length %d does not match size %d", len(b), size)
+	}
+
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	v.store.files[v.prefix+path] = b
+	return nil
+}
+
+func (v *memVolume) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	v.store.mu.RLock()
+	b, ok := v.store.files[v.prefix+path]
+	v.store.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	b = b[offset:]
+
+	if length >= 0 && length < int64(len(b)) {
+		b = b[:length]
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (v *memVolume) Head(ctx context.Context, path string) (int64, error) {
+	v.store.mu.RLock()
+	defer v.store.mu.RUnlock()
+
+	b, ok := v.store.files[v.prefix+path]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int64(len(b)), nil
+}
+
+func (v *memVolume) Delete(ctx context.Context, path string) error {
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	delete(v.store.files, v.prefix+path)
+	return nil
+}
+
+func (v *memVolume) List(ctx context.Context, dir string) ([]File, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	root := dir == "/"
+	dir = v.prefix + dir
+
+	v.store.mu.RLock()
+	defer v.store.mu.RUnlock()
+
+	dirs := make(map[string]bool)
+	files := make([]File, 0)
+	for name, b := range v.store.files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+
+		rest := name[len(dir):]
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			if !dirs[rest[:idx]] {
+				dirs[rest[:idx]] = true
+				files = append(files, File{Name: rest[:idx], Dir: true})
+			}
+			continue
+		}
+		files = append(files, File{Name: rest, Size: int64(len(b))})
+	}
+
+	if len(files) == 0 && !root {
+		return nil, ErrNotFound
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
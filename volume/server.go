@@ -0,0 +1,159 @@
+package volume
+
+// server.go implements a storage server that serves a local directory with the
+// same semantics as the nginx WebDAV configuration in the storage script:
+// - PUT writes a file creating any missing directories.
+// - DELETE removes a file.
+// - GET and HEAD read a file with support for range requests.
+// - GET on a directory returns a listing in the nginx json autoindex format.
+//
+// Additionally GET /?usage returns the disk usage of the directory as json.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Server is a http storage server serving a local directory.
+type Server struct {
+	dir *dirVolume
+}
+
+// NewServer returns a storage server that serves the directory at root.
+func NewServer(root string) *Server {
+	return &Server{dir: &dirVolume{root: root}}
+}
+
+// Usage describes the disk usage of a volume in bytes.
+type Usage struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if path == "/" && r.URL.Query().Has("usage") {
+			s.serveUsage(w)
+			return
+		}
+
+		s.serveFile(w, r, path)
+	case http.MethodPut:
+		if strings.HasSuffix(path, "/") {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if err := s.dir.Put(r.Context(), path, r.Body, r.ContentLength); err != nil {
+			log.Printf("volume: put %s: %s\n", path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		info, err := os.Stat(s.dir.file(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err == nil && info.IsDir() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if err == nil {
+			err = s.dir.Delete(r.Context(), path)
+		}
+
+		if err != nil {
+			log.Printf("volume: delete %s: %s\n", path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	name := s.dir.file(path)
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !info.IsDir() {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+
+	// same as nginx, directories are only listed with a trailing slash.
+	if !strings.HasSuffix(path, "/") {
+		http.Redirect(w, r, path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	files, err := s.dir.List(r.Context(), path)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	index := make([]autoindexFile, len(files))
+	for i, f := range files {
+		index[i] = autoindexFile{
+			Name:  f.Name,
+			Type:  "file",
+			MTime: f.ModTime.UTC().Format(http.TimeFormat),
+			Size:  f.Size,
+		}
+
+		if f.Dir {
+			index[i].Type = "directory"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(index)
+	}
+}
+
+func (s *Server) serveUsage(w http.ResponseWriter) {
+	usage, err := diskUsage(s.dir.root)
+	if err != nil {
+		log.Printf("volume: disk usage: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
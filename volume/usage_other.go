@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package volume
+
+import "errors"
+
+func diskUsage(root string) (Usage, error) {
+	return Usage{}, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package volume
+
+import "syscall"
+
+func diskUsage(root string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return Usage{}, err
+	}
+
+	bsize := uint64(st.Bsize)
+	usage := Usage{
+		Total: uint64(st.Blocks) * bsize,
+		Free:  uint64(st.Bavail) * bsize,
+	}
+	usage.Used = usage.Total - uint64(st.Bfree)*bsize
+	return usage, nil
+}
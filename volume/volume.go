@@ -0,0 +1,113 @@
+// Package volume implements access to the storage servers that hold the
+// values. A volume is addressed by a string and the prefix of the address
+// selects the driver:
+// - file:///data/volume1 stores values in a local directory.
+// - mem://name stores values in memory, which is useful for testing.
+// - anything else is a nginx WebDAV server such as localhost:3001.
+//
+// Substorages are addressed by appending the substorage directory to the
+// address, for example localhost:3001/sv0A or file:///data/volume1/sv0A.
+package volume
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a file doesn't exist on a volume.
+var ErrNotFound = errors.New("volume: file not found")
+
+// File describes a single entry in a directory listing.
+type File struct {
+	Name    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+// Volume is a storage server holding files. Paths always begin with a slash.
+type Volume interface {
+	// Put writes body into path creating any missing directories. If size is
+	// not negative, the body has to be exactly size bytes long.
+	Put(ctx context.Context, path string, body io.Reader, size int64) error
+
+	// Get reads length bytes starting from offset from the file at path. If
+	// length is negative, the file is read until the end.
+	Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+
+	// Head returns the size of the file at path.
+	Head(ctx context.Context, path string) (int64, error)
+
+	// Delete removes the file at path. Deleting a missing file is not an error.
+	Delete(ctx context.Context, path string) error
+
+	// List returns the files in the directory at dir.
+	List(ctx context.Context, dir string) ([]File, error)
+}
+
+// Locator is implemented by volumes that can be accessed directly by clients.
+type Locator interface {
+	// URL returns the address from which clients can read the file at path.
+	URL(path string) string
+}
+
+// Typed is implemented by the readers of files on volumes that know the
+// content types of the files, such as web servers.
+type Typed interface {
+	// ContentType returns the content type of the file.
+	ContentType() string
+}
+
+// Sized is implemented by the readers of files on volumes that tell the size
+// of the whole file when it's read, so that it doesn't have to be asked
+// separately.
+type Sized interface {
+	// Size returns the size of the whole file, or a negative number if the
+	// size is not known.
+	Size() int64
+}
+
+// Open returns the volume for the given address.
+func Open(addr string) Volume {
+	switch {
+	case strings.HasPrefix(addr, "file://"):
+		return &dirVolume{root: strings.TrimPrefix(addr, "file://")}
+	case strings.HasPrefix(addr, "mem://"):
+		return openMem(strings.TrimPrefix(addr, "mem://"))
+	default:
+		return &httpVolume{base: httpBase(addr)}
+	}
+}
+
+// Copy streams the file at path from one volume to another.
+func Copy(ctx context.Context, from, to Volume, path string) error {
+	size, err := from.Head(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	r, err := from.Get(ctx, path, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return to.Put(ctx, path, r, size)
+}
+
+// limitReadCloser limits the amount of bytes read while still closing the
+// underlying reader.
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func limit(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+	return limitReadCloser{io.LimitReader(rc, length), rc}
+}
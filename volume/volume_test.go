@@ -0,0 +1,108 @@
+package volume_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nireo/jakaja/volume"
+)
+
+// testVolume runs the same operations against a volume of any driver.
+func testVolume(t *testing.T, v volume.Volume) {
+	ctx := context.Background()
+
+	if err := v.Put(ctx, "/ab/cd/file", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if err := v.Put(ctx, "/ab/cd/short", strings.NewReader("hello"), 11); err == nil {
+		t.Fatalf("put with wrong size succeeded")
+	}
+
+	size, err := v.Head(ctx, "/ab/cd/file")
+	if err != nil || size != 11 {
+		t.Fatalf("head: got size %d and error %v", size, err)
+	}
+
+	if _, err := v.Head(ctx, "/ab/cd/missing"); !errors.Is(err, volume.ErrNotFound) {
+		t.Fatalf("head of missing file: got error %v", err)
+	}
+
+	reads := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "hello world"},
+		{6, -1, "world"},
+		{0, 5, "hello"},
+		{4, 3, "o w"},
+		{11, -1, ""},
+	}
+
+	for _, r := range reads {
+		rc, err := v.Get(ctx, "/ab/cd/file", r.offset, r.length)
+		if err != nil {
+			t.Fatalf("get %d-%d: %s", r.offset, r.length, err)
+		}
+
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(b) != r.want {
+			t.Fatalf("get %d-%d: got %q and error %v", r.offset, r.length, b, err)
+		}
+	}
+
+	files, err := v.List(ctx, "/")
+	if err != nil || len(files) != 1 || files[0].Name != "ab" || !files[0].Dir {
+		t.Fatalf("list root: got %+v and error %v", files, err)
+	}
+
+	files, err = v.List(ctx, "/ab/cd/")
+	if err != nil || len(files) != 1 || files[0].Name != "file" || files[0].Dir || files[0].Size != 11 {
+		t.Fatalf("list directory: got %+v and error %v", files, err)
+	}
+
+	if err := v.Delete(ctx, "/ab/cd/file"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	if err := v.Delete(ctx, "/ab/cd/file"); err != nil {
+		t.Fatalf("delete of missing file: %s", err)
+	}
+
+	if _, err := v.Get(ctx, "/ab/cd/file", 0, -1); !errors.Is(err, volume.ErrNotFound) {
+		t.Fatalf("get of deleted file: got error %v", err)
+	}
+}
+
+func Test_dirVolume(t *testing.T) {
+	testVolume(t, volume.Open("file://"+t.TempDir()))
+}
+
+func Test_memVolume(t *testing.T) {
+	testVolume(t, volume.Open("mem://"+t.Name()))
+}
+
+func Test_substorage(t *testing.T) {
+	ctx := context.Background()
+	root := "mem://" + t.Name()
+
+	if err := volume.Open(root+"/sv01").Put(ctx, "/file", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if _, err := volume.Open(root).Head(ctx, "/sv01/file"); err != nil {
+		t.Fatalf("file not found from the parent volume: %s", err)
+	}
+}
+
+func Test_httpVolume(t *testing.T) {
+	srv := httptest.NewServer(volume.NewServer(t.TempDir()))
+	defer srv.Close()
+
+	testVolume(t, volume.Open(srv.URL))
+}